@@ -0,0 +1,48 @@
+package api
+
+import (
+	"fmt"
+
+	"github.com/mcdonaldseanp/clibuild/errtype"
+)
+
+const DEFAULT_LISTEN string = "127.0.0.1:8420"
+
+// Specs are small, anything bigger than this is refused
+const DEFAULT_MAX_REQUEST_SIZE int64 = 1024 * 1024
+
+// Options for serving the api, separate from the local.Options
+// that every run uses
+type Options struct {
+	// host:port to listen on, unless Socket is set
+	Listen string
+	// Path to a unix socket to listen on instead of Listen. Only
+	// the user running lookout can connect to it
+	Socket string
+	// Every request has to send "Authorization: Bearer TOKEN". Can
+	// only be empty when listening on a unix socket
+	Token []byte
+	// Largest spec accepted in a request body, in bytes
+	Max_Request_Size int64
+}
+
+func NewOptions(listen string, socket string, token []byte, max_request_size int64) (Options, error) {
+	if len(token) < 1 && socket == "" {
+		return Options{}, &errtype.InvalidInput{
+			Message: "a token from --token-env or --token-file is required unless listening on --socket",
+			Origin:  nil,
+		}
+	}
+	if max_request_size < 1 {
+		return Options{}, &errtype.InvalidInput{
+			Message: fmt.Sprintf("--max-request-size must be at least 1, given %d", max_request_size),
+			Origin:  nil,
+		}
+	}
+	return Options{
+		Listen:           listen,
+		Socket:           socket,
+		Token:            token,
+		Max_Request_Size: max_request_size,
+	}, nil
+}
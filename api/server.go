@@ -0,0 +1,294 @@
+package api
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/mcdonaldseanp/clibuild/errtype"
+	"github.com/mcdonaldseanp/lookout/local"
+	"github.com/mcdonaldseanp/lookout/localdata"
+	"github.com/mcdonaldseanp/lookout/localexec"
+)
+
+// How long shutting down waits for requests that are still
+// running, after their implements and actions are cancelled
+const SHUTDOWN_TIMEOUT time.Duration = 30 * time.Second
+
+// Results are returned exactly as local.Observe, local.React and
+// local.Run render them. Which spec they came from and when are
+// sent as headers
+const (
+	SPEC_HEADER string = "X-Lookout-Spec"
+	TIME_HEADER string = "X-Lookout-Time"
+)
+
+// The last results for one route, e.g. "observe" or "run/restart"
+type lastResult struct {
+	spec    string
+	time    time.Time
+	results string
+}
+
+type runFunc func(sources []localdata.Source, opts local.Options) (string, error)
+
+type server struct {
+	opts     Options
+	run_opts local.Options
+	lock     sync.Mutex
+	// Whether a react or run request is running right now. Only
+	// one runs at a time, since different specs can still run the
+	// same actions. Observing doesn't change anything, so any
+	// number of observe requests can run alongside
+	changing bool
+	last     map[string]lastResult
+}
+
+// ReadToken reads the api token the same way as other secrets. The
+// environment variable is cleared afterwards so that implements
+// never see it
+func ReadToken(env_name string, file string) ([]byte, error) {
+	token, err := localdata.ReadSecret(env_name, file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read api token: %s", err)
+	}
+	if env_name != "" {
+		os.Unsetenv(env_name)
+	}
+	return token, nil
+}
+
+func apiLog(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, time.Now().Format(time.RFC3339)+" "+format+"\n", args...)
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	json_output, err := json.Marshal(map[string]string{"error": message})
+	if err != nil {
+		json_output = []byte(`{"error":"could not render error as JSON"}`)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(json_output)
+}
+
+func writeResults(w http.ResponseWriter, last lastResult) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set(SPEC_HEADER, last.spec)
+	w.Header().Set(TIME_HEADER, last.time.Format(time.RFC3339))
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(last.results))
+}
+
+func (srv *server) authorized(r *http.Request) bool {
+	if len(srv.opts.Token) < 1 {
+		return true
+	}
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		return false
+	}
+	given := strings.TrimPrefix(header, "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(given), srv.opts.Token) == 1
+}
+
+// claim marks a react or run request as running, or returns false
+// if one already is. Observe requests can always run
+func (srv *server) claim(name string) bool {
+	if name == "observe" {
+		return true
+	}
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+	if srv.changing {
+		return false
+	}
+	srv.changing = true
+	return true
+}
+
+func (srv *server) release(name string) {
+	if name == "observe" {
+		return
+	}
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+	srv.changing = false
+}
+
+// route picks what a path runs: /observe, /react or /run/ACTION
+func route(path string) (string, runFunc) {
+	name := strings.Trim(path, "/")
+	switch name {
+	case "observe":
+		return name, local.Observe
+	case "react":
+		return name, local.React
+	}
+	actn_name := strings.TrimPrefix(name, "run/")
+	if actn_name == name || actn_name == "" || strings.Contains(actn_name, "/") {
+		return "", nil
+	}
+	return name, func(sources []localdata.Source, opts local.Options) (string, error) {
+		return local.Run(sources, actn_name, opts)
+	}
+}
+
+func (srv *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	started := time.Now()
+	status := srv.serve(w, r)
+	apiLog("%s %s %d %s", r.Method, r.URL.Path, status, time.Since(started).Round(time.Millisecond))
+}
+
+func (srv *server) serve(w http.ResponseWriter, r *http.Request) int {
+	if !srv.authorized(r) {
+		writeError(w, http.StatusUnauthorized, "missing or invalid token")
+		return http.StatusUnauthorized
+	}
+	name, run := route(r.URL.Path)
+	if run == nil {
+		writeError(w, http.StatusNotFound, "no such endpoint, use /observe, /react or /run/ACTION")
+		return http.StatusNotFound
+	}
+	switch r.Method {
+	case http.MethodGet:
+		srv.lock.Lock()
+		last, found := srv.last[name]
+		srv.lock.Unlock()
+		if !found {
+			writeError(w, http.StatusNotFound, fmt.Sprintf("/%s has not been run yet", name))
+			return http.StatusNotFound
+		}
+		writeResults(w, last)
+		return http.StatusOK
+	case http.MethodPost:
+		return srv.run(w, r, name, run)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		writeError(w, http.StatusMethodNotAllowed, "only GET and POST are allowed")
+		return http.StatusMethodNotAllowed
+	}
+}
+
+// run reads a spec from the request body and runs it. The spec is
+// the same yaml that observe, react and run take with --stdin.
+// Sending ?plan=true runs it like --plan
+func (srv *server) run(w http.ResponseWriter, r *http.Request, name string, run runFunc) int {
+	// Read one byte more than allowed to tell whether the
+	// body was too big
+	body, err := io.ReadAll(io.LimitReader(r.Body, srv.opts.Max_Request_Size+1))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("failed to read request body: %s", err))
+		return http.StatusBadRequest
+	}
+	if int64(len(body)) > srv.opts.Max_Request_Size {
+		writeError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("spec is larger than %d bytes", srv.opts.Max_Request_Size))
+		return http.StatusRequestEntityTooLarge
+	}
+	if len(strings.TrimSpace(string(body))) < 1 {
+		writeError(w, http.StatusBadRequest, "request body must be a spec")
+		return http.StatusBadRequest
+	}
+	checksum := sha256.Sum256(body)
+	spec := hex.EncodeToString(checksum[:])
+	if !srv.claim(name) {
+		writeError(w, http.StatusConflict, "another react or run request is already running")
+		return http.StatusConflict
+	}
+	defer srv.release(name)
+
+	opts := srv.run_opts
+	if r.URL.Query().Get("plan") == "true" {
+		opts.Plan = true
+	}
+	results, err := run([]localdata.Source{{Name: "request", Data: body}}, opts)
+	if err != nil {
+		if invalid, ok := err.(*errtype.InvalidInput); ok {
+			writeError(w, http.StatusBadRequest, strings.TrimSpace(invalid.Message))
+			return http.StatusBadRequest
+		}
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return http.StatusInternalServerError
+	}
+	last := lastResult{spec: spec, time: time.Now(), results: results}
+	srv.lock.Lock()
+	srv.last[name] = last
+	srv.lock.Unlock()
+	writeResults(w, last)
+	return http.StatusOK
+}
+
+func listen(opts Options) (net.Listener, error) {
+	if opts.Socket == "" {
+		return net.Listen("tcp", opts.Listen)
+	}
+	// Clear out a socket left behind by a lookout that didn't
+	// shut down cleanly, but never anything else
+	if info, err := os.Lstat(opts.Socket); err == nil && info.Mode()&os.ModeSocket != 0 {
+		os.Remove(opts.Socket)
+	}
+	listener, err := net.Listen("unix", opts.Socket)
+	if err != nil {
+		return nil, err
+	}
+	err = os.Chmod(opts.Socket, 0600)
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// Serve runs the api until SIGTERM or ctrl-c. Shutting down
+// cancels every implement and action that is still running, so
+// that requests in flight finish with failed results
+func Serve(run_opts local.Options, opts Options) error {
+	listener, err := listen(opts)
+	if err != nil {
+		return fmt.Errorf("failed to listen: %s", err)
+	}
+	srv := &server{
+		opts:     opts,
+		run_opts: run_opts,
+		last:     make(map[string]lastResult),
+	}
+	http_server := &http.Server{
+		Handler:           srv,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, os.Interrupt)
+	defer signal.Stop(stop)
+	stopped := make(chan error, 1)
+	go func() {
+		sig := <-stop
+		apiLog("Received %s, stopping", sig)
+		localexec.CancelAll()
+		ctx, cancel := context.WithTimeout(context.Background(), SHUTDOWN_TIMEOUT)
+		defer cancel()
+		stopped <- http_server.Shutdown(ctx)
+	}()
+	apiLog("Serving api on %s", listener.Addr())
+	err = http_server.Serve(listener)
+	if err != http.ErrServerClosed {
+		return err
+	}
+	err = <-stopped
+	if err != nil {
+		return fmt.Errorf("failed to stop cleanly: %s", err)
+	}
+	apiLog("Stopped api")
+	return nil
+}
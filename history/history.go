@@ -0,0 +1,261 @@
+package history
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mcdonaldseanp/lookout/operation"
+)
+
+// Every result is appended to a json lines file for the day (UTC)
+// it was recorded on, e.g. ~/.lookout/history/2024-05-01.jsonl
+const HISTORY_LOC string = ".lookout/history"
+
+// How many days of history are kept when --history-days isn't
+// given. Files for older days are deleted when results are
+// recorded, see prune
+const DEFAULT_HISTORY_DAYS int = 30
+
+const history_day_format string = "2006-01-02"
+
+const (
+	STATUS_EXPECTED   string = "expected"
+	STATUS_UNEXPECTED string = "unexpected"
+	STATUS_SUCCEEDED  string = "succeeded"
+	STATUS_SKIPPED    string = "skipped"
+	STATUS_PLANNED    string = "planned"
+	STATUS_FAILED     string = "failed"
+)
+
+// One observation or reaction result. Observations are expected,
+// unexpected or failed, reactions are succeeded, skipped, planned
+// or failed
+type Record struct {
+	Time   time.Time `yaml:"time" json:"time"`
+	Target string    `yaml:"target" json:"target"`
+	// observation or reaction
+	Kind string `yaml:"kind" json:"kind"`
+	Name string `yaml:"name" json:"name"`
+	// For reactions, the observation they react to
+	Observation string `yaml:"observation,omitempty" json:"observation,omitempty"`
+	Status      string `yaml:"status" json:"status"`
+	// The observation result, or the reaction message
+	Result string `yaml:"result" json:"result"`
+	// Only set when showing transitions, from the record
+	// before this one
+	Previous_Status string `yaml:"previous_status,omitempty" json:"previous_status,omitempty"`
+	Previous_Result string `yaml:"previous_result,omitempty" json:"previous_result,omitempty"`
+}
+
+// Appends from the same process, e.g. parallel api requests,
+// go through one at a time
+var write_lock sync.Mutex
+
+// The last day history was pruned on, so that an agent or api that
+// runs for days only prunes once a day. Guarded by write_lock
+var pruned_on string
+
+func historyDir() string {
+	return filepath.Join(os.Getenv("HOME"), HISTORY_LOC)
+}
+
+// LocalTarget is the target that results from this machine are
+// recorded under
+func LocalTarget() string {
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		return "localhost"
+	}
+	return hostname
+}
+
+func observationRecords(target string, at time.Time, observations map[string]operation.ObservationResult) []Record {
+	records := []Record{}
+	for obsv_name, obsv_result := range observations {
+		record := Record{
+			Time:   at,
+			Target: target,
+			Kind:   "observation",
+			Name:   obsv_name,
+			Status: STATUS_EXPECTED,
+			Result: strings.TrimSpace(obsv_result.Result),
+		}
+		if !obsv_result.Succeeded {
+			record.Status = STATUS_FAILED
+		} else if !obsv_result.Expected {
+			record.Status = STATUS_UNEXPECTED
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+func reactionRecords(target string, at time.Time, reactions map[string]operation.ReactionResult) []Record {
+	records := []Record{}
+	for rctn_name, rctn_result := range reactions {
+		record := Record{
+			Time:        at,
+			Target:      target,
+			Kind:        "reaction",
+			Name:        rctn_name,
+			Observation: rctn_result.Reaction.Observation,
+			Status:      STATUS_SUCCEEDED,
+			Result:      rctn_result.Message,
+		}
+		if rctn_result.Planned_Action != nil {
+			record.Status = STATUS_PLANNED
+		} else if rctn_result.Skipped {
+			record.Status = STATUS_SKIPPED
+		}
+		// Reactions skipped because something went wrong
+		// are failures too
+		if !rctn_result.Succeeded {
+			record.Status = STATUS_FAILED
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+// prune deletes the files for days that are more than keep_days
+// old, keeping today and the keep_days - 1 days before it. Zero
+// keeps everything
+func prune(keep_days int, now time.Time) error {
+	today := now.UTC().Format(history_day_format)
+	if keep_days < 1 || pruned_on == today {
+		return nil
+	}
+	oldest := now.UTC().AddDate(0, 0, 1-keep_days).Format(history_day_format)
+	entries, err := os.ReadDir(historyDir())
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".jsonl") {
+			continue
+		}
+		if strings.TrimSuffix(entry.Name(), ".jsonl") < oldest {
+			err = os.Remove(filepath.Join(historyDir(), entry.Name()))
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	pruned_on = today
+	return nil
+}
+
+// appendRecords writes every record as a single line, with one write
+// per file so that several lookouts appending at once don't mix
+// their lines together. History older than keep_days is pruned
+// afterwards
+func appendRecords(records []Record, keep_days int) error {
+	if len(records) < 1 {
+		return nil
+	}
+	write_lock.Lock()
+	defer write_lock.Unlock()
+	err := os.MkdirAll(historyDir(), 0700)
+	if err != nil {
+		return err
+	}
+	days := make(map[string]*bytes.Buffer)
+	for _, record := range records {
+		json_output, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		day := record.Time.UTC().Format(history_day_format)
+		if days[day] == nil {
+			days[day] = &bytes.Buffer{}
+		}
+		days[day].Write(json_output)
+		days[day].WriteString("\n")
+	}
+	for day, lines := range days {
+		file, err := os.OpenFile(filepath.Join(historyDir(), day+".jsonl"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			return err
+		}
+		_, err = file.Write(lines.Bytes())
+		file.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return prune(keep_days, time.Now())
+}
+
+// Recording history never fails a run, problems are only printed
+// as warnings
+func record(records []Record, keep_days int) {
+	err := appendRecords(records, keep_days)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: failed to record history in %s: %s\n", historyDir(), err)
+	}
+}
+
+// RecordObservations and RecordReactions keep keep_days of
+// history, see prune
+func RecordObservations(target string, results operation.ObservationResults, keep_days int) {
+	record(observationRecords(target, time.Now().UTC(), results.Observations), keep_days)
+}
+
+func RecordReactions(target string, results operation.ReactionResults, keep_days int) {
+	at := time.Now().UTC()
+	record(append(
+		observationRecords(target, at, results.Observations),
+		reactionRecords(target, at, results.Reactions)...,
+	), keep_days)
+}
+
+// readRecords reads every record from days up to and including
+// until, oldest first. A zero until reads everything. Lines that
+// can't be parsed, like one cut off by a crash, are skipped
+func readRecords(until time.Time) ([]Record, error) {
+	entries, err := os.ReadDir(historyDir())
+	if os.IsNotExist(err) {
+		return []Record{}, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read history in %s: %s", historyDir(), err)
+	}
+	records := []Record{}
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".jsonl") {
+			continue
+		}
+		day := strings.TrimSuffix(entry.Name(), ".jsonl")
+		if !until.IsZero() && day > until.UTC().Format(history_day_format) {
+			continue
+		}
+		file, err := os.Open(filepath.Join(historyDir(), entry.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read history in %s: %s", historyDir(), err)
+		}
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+		for scanner.Scan() {
+			var record Record
+			if json.Unmarshal(scanner.Bytes(), &record) == nil {
+				records = append(records, record)
+			}
+		}
+		err = scanner.Err()
+		file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read history file %s: %s", entry.Name(), err)
+		}
+	}
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].Time.Before(records[j].Time)
+	})
+	return records, nil
+}
@@ -0,0 +1,178 @@
+package history
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mcdonaldseanp/clibuild/errtype"
+	"github.com/mcdonaldseanp/lookout/render"
+)
+
+// Filter picks which records get history shows. Empty fields
+// match everything
+type Filter struct {
+	// Matches observations by name, and reactions to them
+	Observation string
+	Target      string
+	Since       time.Time
+	Until       time.Time
+	// Only show records where the result changed from the
+	// record before it, e.g. from expected to unexpected
+	Transitions bool
+}
+
+type History struct {
+	Records []Record `yaml:"records" json:"records"`
+}
+
+// ParseTime reads --since and --until, which are either a time like
+// 2024-05-01T10:00:00Z or 2024-05-01, or how long ago, like 90m or 7d.
+// A date on its own is the start of that day
+func ParseTime(raw string, now time.Time) (time.Time, error) {
+	moment, _, err := parseTime(raw, now)
+	return moment, err
+}
+
+// ParseUntil reads --until like ParseTime, except that a date on
+// its own is the end of that day, so that the whole day is included
+func ParseUntil(raw string, now time.Time) (time.Time, error) {
+	moment, is_day, err := parseTime(raw, now)
+	if err != nil || !is_day {
+		return moment, err
+	}
+	return moment.AddDate(0, 0, 1).Add(-time.Nanosecond), nil
+}
+
+// parseTime also reports whether the time was just a date
+func parseTime(raw string, now time.Time) (time.Time, bool, error) {
+	if raw == "" {
+		return time.Time{}, false, nil
+	}
+	if moment, err := time.Parse(time.RFC3339, raw); err == nil {
+		return moment, false, nil
+	}
+	if moment, err := time.ParseInLocation(history_day_format, raw, time.Local); err == nil {
+		return moment, true, nil
+	}
+	if strings.HasSuffix(raw, "d") {
+		if count, err := strconv.Atoi(strings.TrimSuffix(raw, "d")); err == nil && count >= 0 {
+			return now.AddDate(0, 0, -count), false, nil
+		}
+	}
+	if ago, err := time.ParseDuration(raw); err == nil && ago >= 0 {
+		return now.Add(-ago), false, nil
+	}
+	return time.Time{}, false, &errtype.InvalidInput{
+		Message: fmt.Sprintf("'%s' is not a time like 2024-05-01T10:00:00Z or 2024-05-01, or a time ago like 90m or 7d", raw),
+		Origin:  nil,
+	}
+}
+
+func (filter Filter) matches(record Record) bool {
+	if filter.Observation != "" {
+		if record.Kind == "observation" && record.Name != filter.Observation {
+			return false
+		}
+		if record.Kind == "reaction" && record.Observation != filter.Observation {
+			return false
+		}
+	}
+	if filter.Target != "" && record.Target != filter.Target {
+		return false
+	}
+	if !filter.Since.IsZero() && record.Time.Before(filter.Since) {
+		return false
+	}
+	if !filter.Until.IsZero() && record.Time.After(filter.Until) {
+		return false
+	}
+	return true
+}
+
+// What counts as a change between two records. Failed observations
+// and reactions only compare their status, because their messages
+// tend to hold things like temp file names that change every run
+func (rec Record) state() string {
+	if rec.Kind == "observation" && rec.Status != STATUS_FAILED {
+		return rec.Status + "\n" + rec.Result
+	}
+	return rec.Status
+}
+
+// Query returns the records that match the filter, oldest first.
+// Transitions are worked out from every earlier record, not just
+// the ones that match, so the first record after --since is only
+// a transition if it really changed
+func Query(filter Filter) (History, error) {
+	records, err := readRecords(filter.Until)
+	if err != nil {
+		return History{}, err
+	}
+	history := History{Records: []Record{}}
+	previous := make(map[string]Record)
+	for _, record := range records {
+		key := record.Target + "\n" + record.Kind + "\n" + record.Name
+		last, seen := previous[key]
+		previous[key] = record
+		if !filter.matches(record) {
+			continue
+		}
+		if filter.Transitions {
+			if seen && last.state() == record.state() {
+				continue
+			}
+			if seen {
+				record.Previous_Status = last.Status
+				record.Previous_Result = last.Result
+			}
+		}
+		history.Records = append(history.Records, record)
+	}
+	return history, nil
+}
+
+var case_status = map[string]string{
+	STATUS_EXPECTED:   render.CASE_PASSED,
+	STATUS_SUCCEEDED:  render.CASE_PASSED,
+	STATUS_SKIPPED:    render.CASE_SKIPPED,
+	STATUS_PLANNED:    render.CASE_SKIPPED,
+	STATUS_UNEXPECTED: render.CASE_FAILED,
+	STATUS_FAILED:     render.CASE_FAILED,
+}
+
+// Cases lets history be shown as a table, junit or tap, with the
+// time and any transition in the summary
+func (history History) Cases() []render.Case {
+	cases := []render.Case{}
+	for _, record := range history.Records {
+		summary := record.Time.Local().Format(time.RFC3339) + " " + record.Status
+		if record.Previous_Status != "" {
+			summary += " (was " + record.Previous_Status + ")"
+		}
+		if record.Result != "" {
+			summary += ": " + record.Result
+		}
+		cases = append(cases, render.Case{
+			Target:  record.Target,
+			Kind:    record.Kind,
+			Name:    record.Name,
+			Status:  case_status[record.Status],
+			Summary: summary,
+		})
+	}
+	return cases
+}
+
+func CLIGetHistory(filter Filter, output string) error {
+	err := render.ValidateFormat(output)
+	if err != nil {
+		return err
+	}
+	history, err := Query(filter)
+	if err != nil {
+		return err
+	}
+	return render.Print(history, output)
+}
@@ -13,7 +13,7 @@ import (
 )
 
 func runGcloudInstanceList(gcloud_project string) ([]map[string]interface{}, error) {
-	output, logs, err := localexec.ExecReadOutput("gcloud", []string{"compute", "instances", "list", "--format=json", "--project=" + gcloud_project})
+	output, logs, err := localexec.ExecReadOutput("gcloud", "compute", "instances", "list", "--format=json", "--project="+gcloud_project)
 	if err != nil {
 		return nil, err
 	}
@@ -54,6 +54,32 @@ func readInstanceNames(state string, gcloud_project string) error {
 	return nil
 }
 
+// Prints both the count and the names as JSON so that observations
+// can select whichever field they need instead of parsing a comma
+// separated list
+func readInstanceSummary(state string, gcloud_project string) error {
+	instance_names := []string{}
+	instance_data, err := runGcloudInstanceList(gcloud_project)
+	if err != nil {
+		return err
+	}
+	for _, instance := range instance_data {
+		if instance["status"] == state {
+			instance_names = append(instance_names, instance["name"].(string))
+		}
+	}
+	sort.Strings(instance_names)
+	json_output, json_err := json.Marshal(map[string]interface{}{
+		"count": len(instance_names),
+		"names": instance_names,
+	})
+	if json_err != nil {
+		return fmt.Errorf("could not render result as JSON: %s", json_err)
+	}
+	fmt.Print(string(json_output))
+	return nil
+}
+
 func main() {
 	command_list := []cli.Command{
 		{
@@ -90,6 +116,23 @@ func main() {
 				os.Exit(0)
 			},
 		},
+		{
+			Verb:     "summarize",
+			Noun:     "instances",
+			Supports: []string{"linux", "windows"},
+			ExecutionFn: func() {
+				usage := "gcloud_compute_impl summarize instances [STATE] [GCLOUD_PROJECT]"
+				description := "return the count and names of instances in STATE as JSON"
+				cli.ShouldHaveArgs(4, usage, description, nil)
+				cli.HandleCommandError(
+					readInstanceSummary(os.Args[3], os.Args[4]),
+					usage,
+					description,
+					nil,
+				)
+				os.Exit(0)
+			},
+		},
 	}
 	cli.RunCommandRaw("gcloud_compute_impl", version.VERSION, command_list)
 }
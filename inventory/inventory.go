@@ -0,0 +1,240 @@
+package inventory
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/mcdonaldseanp/clibuild/errtype"
+	"gopkg.in/yaml.v2"
+)
+
+// The implicit group that holds every host in the inventory
+const ALL_GROUP string = "all"
+
+// Connection settings and variables that can be set on a host
+// or a group. Empty settings are left to the CLI flags and the
+// ssh config file
+type Settings struct {
+	Host_Name     string            `yaml:"host_name,omitempty" json:"host_name,omitempty"`
+	User          string            `yaml:"user,omitempty" json:"user,omitempty"`
+	Port          string            `yaml:"port,omitempty" json:"port,omitempty"`
+	Identity_File string            `yaml:"identity_file,omitempty" json:"identity_file,omitempty"`
+	Proxy_Jump    string            `yaml:"proxy_jump,omitempty" json:"proxy_jump,omitempty"`
+	Vars          map[string]string `yaml:"vars,omitempty" json:"vars,omitempty"`
+}
+
+type Group struct {
+	Hosts    []string `yaml:"hosts" json:"hosts"`
+	Settings `yaml:",inline"`
+}
+
+// An inventory lists the hosts lookout can connect to:
+//
+//	hosts:
+//	  web1:
+//	    host_name: 10.0.0.10
+//	  web2:
+//	    port: 2222
+//	groups:
+//	  web:
+//	    hosts: [web1, web2]
+//	    user: deploy
+//	    vars:
+//	      service: nginx
+//
+// Host settings win over group settings. When a host is in more than
+// one group, groups are applied in alphabetical order so later groups
+// win
+type Inventory struct {
+	Hosts  map[string]Settings `yaml:"hosts" json:"hosts"`
+	Groups map[string]Group    `yaml:"groups" json:"groups"`
+}
+
+// A host selected from the inventory with its group
+// settings already applied
+type Host struct {
+	Name     string
+	Settings Settings
+}
+
+func sortedNames[T any](items map[string]T) []string {
+	names := make([]string, 0, len(items))
+	for name := range items {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Parse reads an inventory with the same strict yaml parsing as
+// specs, so misspelled keys are reported instead of ignored
+func Parse(raw_data []byte, source string) (*Inventory, error) {
+	var inv Inventory
+	err := yaml.UnmarshalStrict(raw_data, &inv)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse yaml in inventory %s:\n%s", source, err)
+	}
+	if inv.Hosts == nil {
+		inv.Hosts = make(map[string]Settings)
+	}
+	if inv.Groups == nil {
+		inv.Groups = make(map[string]Group)
+	}
+	if _, found := inv.Groups[ALL_GROUP]; found {
+		return nil, &errtype.InvalidInput{
+			Message: fmt.Sprintf("inventory %s cannot define group '%s', it always holds every host", source, ALL_GROUP),
+			Origin:  nil,
+		}
+	}
+	for _, host_name := range sortedNames(inv.Hosts) {
+		if host_name == "" || strings.ContainsAny(host_name, ",*?[") {
+			return nil, &errtype.InvalidInput{
+				Message: fmt.Sprintf("inventory %s has an invalid host name '%s'", source, host_name),
+				Origin:  nil,
+			}
+		}
+	}
+	for _, group_name := range sortedNames(inv.Groups) {
+		for _, host_name := range inv.Groups[group_name].Hosts {
+			if _, found := inv.Hosts[host_name]; !found {
+				return nil, &errtype.InvalidInput{
+					Message: fmt.Sprintf("group '%s' in inventory %s lists host '%s', which is not under hosts", group_name, source, host_name),
+					Origin:  nil,
+				}
+			}
+		}
+	}
+	return &inv, nil
+}
+
+func Load(inventory_file string) (*Inventory, error) {
+	raw_data, err := os.ReadFile(inventory_file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read inventory:\n%s", err)
+	}
+	return Parse(raw_data, inventory_file)
+}
+
+// merge applies settings on top of base, only overriding what
+// is set. Vars are merged key by key
+func merge(base Settings, settings Settings) Settings {
+	if settings.Host_Name != "" {
+		base.Host_Name = settings.Host_Name
+	}
+	if settings.User != "" {
+		base.User = settings.User
+	}
+	if settings.Port != "" {
+		base.Port = settings.Port
+	}
+	if settings.Identity_File != "" {
+		base.Identity_File = settings.Identity_File
+	}
+	if settings.Proxy_Jump != "" {
+		base.Proxy_Jump = settings.Proxy_Jump
+	}
+	if len(settings.Vars) > 0 {
+		vars := make(map[string]string)
+		for key, value := range base.Vars {
+			vars[key] = value
+		}
+		for key, value := range settings.Vars {
+			vars[key] = value
+		}
+		base.Vars = vars
+	}
+	return base
+}
+
+// HostSettings returns the settings for a host with the settings
+// of every group it's in applied first
+func (inv *Inventory) HostSettings(host_name string) Settings {
+	settings := Settings{}
+	for _, group_name := range sortedNames(inv.Groups) {
+		for _, member := range inv.Groups[group_name].Hosts {
+			if member == host_name {
+				settings = merge(settings, inv.Groups[group_name].Settings)
+				break
+			}
+		}
+	}
+	return merge(settings, inv.Hosts[host_name])
+}
+
+// IsSelector reports whether a target list can select more
+// than one host, either by listing several or with a group or
+// glob selector
+func IsSelector(raw_targets string) bool {
+	return strings.ContainsAny(raw_targets, ",*?[") || strings.Contains(raw_targets, "group:")
+}
+
+// Select picks hosts from a comma separated list of selectors:
+//
+//	group:web   every host in the web group, group:all is every host
+//	web*        every host whose name matches the glob
+//	web1        a single host
+//
+// Every selector has to match at least one host, so that a typo
+// doesn't quietly skip part of a fleet
+func (inv *Inventory) Select(raw_targets string) ([]Host, error) {
+	selected := []Host{}
+	seen := make(map[string]bool)
+	add := func(host_name string) {
+		if !seen[host_name] {
+			seen[host_name] = true
+			selected = append(selected, Host{Name: host_name, Settings: inv.HostSettings(host_name)})
+		}
+	}
+	for _, selector := range strings.Split(raw_targets, ",") {
+		selector = strings.TrimSpace(selector)
+		if selector == "" {
+			return nil, &errtype.InvalidInput{
+				Message: fmt.Sprintf("target list '%s' has an empty target", raw_targets),
+				Origin:  nil,
+			}
+		}
+		if group_name := strings.TrimPrefix(selector, "group:"); group_name != selector {
+			if group_name == ALL_GROUP {
+				for _, host_name := range sortedNames(inv.Hosts) {
+					add(host_name)
+				}
+				continue
+			}
+			group, found := inv.Groups[group_name]
+			if !found {
+				return nil, &errtype.InvalidInput{
+					Message: fmt.Sprintf("group '%s' is not in the inventory", group_name),
+					Origin:  nil,
+				}
+			}
+			for _, host_name := range group.Hosts {
+				add(host_name)
+			}
+			continue
+		}
+		matched := false
+		for _, host_name := range sortedNames(inv.Hosts) {
+			is_match, err := path.Match(selector, host_name)
+			if err != nil {
+				return nil, &errtype.InvalidInput{
+					Message: fmt.Sprintf("invalid target selector '%s': %s", selector, err),
+					Origin:  nil,
+				}
+			}
+			if is_match {
+				matched = true
+				add(host_name)
+			}
+		}
+		if !matched {
+			return nil, &errtype.InvalidInput{
+				Message: fmt.Sprintf("target '%s' does not match any host in the inventory", selector),
+				Origin:  nil,
+			}
+		}
+	}
+	return selected, nil
+}
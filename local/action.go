@@ -1,7 +1,7 @@
 package local
 
 import (
-	"encoding/json"
+	"errors"
 	"fmt"
 
 	"github.com/mcdonaldseanp/clibuild/errtype"
@@ -10,67 +10,87 @@ import (
 	"github.com/mcdonaldseanp/lookout/localexec"
 	"github.com/mcdonaldseanp/lookout/operation"
 	"github.com/mcdonaldseanp/lookout/operparse"
+	"github.com/mcdonaldseanp/lookout/render"
 )
 
-func RunAction(actn operation.Action) operation.ActionResult {
+func RunAction(actn operation.Action, opts Options) operation.ActionResult {
 	result := operation.ActionResult{
 		Action: actn,
 	}
-	output, logs, cmd_err := localexec.BuildAndRunCommand(actn.Exe, actn.Path, actn.Script, actn.Args)
+	if opts.Plan {
+		result.Succeeded = true
+		result.Logs = "Plan: action was not run"
+		return result
+	}
+	become := opts.becomeFor(actn.Become, actn.Become_User)
+	output, logs, cmd_err := localexec.BuildAndRunCommand(actn.Exe, actn.Path, actn.Script, actn.Args, opts.timeoutFor(actn.Timeout), become)
+	ran_as := fmt.Sprintf("Running as %s\n", localexec.RunningAs(become))
 	if cmd_err != nil {
 		result.Succeeded = false
 		result.Output = output
-		result.Logs = fmt.Sprintf("Error: %s, Logs: %s", cmd_err.(*errtype.ShellError).Message, logs)
+		// Commands that never started, e.g. because a temp file
+		// couldn't be made, fail with plain errors
+		message := cmd_err.Error()
+		var shell_err *errtype.ShellError
+		if errors.As(cmd_err, &shell_err) {
+			message = shell_err.Message
+		}
+		result.Logs = ran_as + fmt.Sprintf("Error: %s, Logs: %s", message, logs)
 	} else {
 		result.Succeeded = true
 		result.Output = output
-		result.Logs = logs
+		result.Logs = ran_as + logs
 	}
 	return result
 }
 
-func Run(raw_data []byte, actn_name string) (string, error) {
+func run(sources []localdata.Source, actn_name string, opts Options) (*operation.ActionResults, error) {
 	err := validator.ValidateParams(fmt.Sprintf(
 		`[{"name":"action name","value":"%s","validate":["NotEmpty"]}]`,
 		actn_name,
 	))
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	var data operation.Operations
-	parse_err := operparse.ParseOperations(raw_data, &data)
+	data, parse_err := parseSpec(sources, opts)
 	if parse_err != nil {
-		return "", parse_err
+		return nil, parse_err
 	}
 	actn := operparse.SelectAction(actn_name, data.Actions)
 	if actn == nil {
-		return "", &errtype.InvalidInput{
+		return nil, &errtype.InvalidInput{
 			Message: fmt.Sprintf("Name \"%s\" does not match any existing action names", actn_name),
 			Origin:  nil,
 		}
 	}
-	result := RunAction(*actn)
-	raw_final_result := operation.ActionResults{Actions: make(map[string]operation.ActionResult)}
-	raw_final_result.Actions[actn_name] = result
+	result := RunAction(*actn, opts)
 	// The result for actions (for now) is an actionresults set with one action
 	// result in the actions field.
-	json_output, json_err := json.Marshal(raw_final_result)
-	if json_err != nil {
-		return "", fmt.Errorf("could not render result as JSON: %s", json_err)
+	raw_final_result := operation.ActionResults{Actions: make(map[string]operation.ActionResult)}
+	raw_final_result.Actions[actn_name] = result
+	return &raw_final_result, nil
+}
+
+func Run(sources []localdata.Source, actn_name string, opts Options) (string, error) {
+	results, err := run(sources, actn_name, opts)
+	if err != nil {
+		return "", err
 	}
-	return string(json_output), nil
+	return render.Render(results, render.OUTPUT_JSON, false)
 }
 
-func CLIRun(maybe_file string, actn_name string) error {
-	// ReadFileOrStdin performs validation on maybe_file
-	raw_data, err := localdata.ReadFileOrStdin(maybe_file)
+func CLIRun(maybe_files []string, actn_name string, opts Options) error {
+	sources, err := localdata.ReadFilesOrStdin(maybe_files)
+	if err != nil {
+		return err
+	}
+	results, err := run(sources, actn_name, opts)
 	if err != nil {
 		return err
 	}
-	result, err := Run(raw_data, actn_name)
+	err = render.Print(results, opts.Output)
 	if err != nil {
 		return err
 	}
-	fmt.Print(result)
-	return nil
+	return ActionsFailure(*results, opts.Fail_On)
 }
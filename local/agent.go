@@ -0,0 +1,398 @@
+package local
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/signal"
+	"reflect"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/mcdonaldseanp/clibuild/errtype"
+	"github.com/mcdonaldseanp/lookout/history"
+	"github.com/mcdonaldseanp/lookout/localdata"
+	"github.com/mcdonaldseanp/lookout/localexec"
+	"github.com/mcdonaldseanp/lookout/operation"
+	"github.com/mcdonaldseanp/lookout/operparse"
+)
+
+// Used by observations that set neither interval nor schedule
+const DEFAULT_AGENT_INTERVAL string = "5m"
+
+// How often the agent checks whether the spec files changed
+const AGENT_RELOAD_INTERVAL time.Duration = 2 * time.Second
+
+// The agent prints one of these as a line of json every time an
+// observation runs, with the results of reacting to it
+type AgentRun struct {
+	Time        time.Time                 `yaml:"time" json:"time"`
+	Observation string                    `yaml:"observation" json:"observation"`
+	Results     operation.ReactionResults `yaml:"results" json:"results"`
+	// Set when the reactions couldn't run at all
+	Error string `yaml:"error,omitempty" json:"error,omitempty"`
+}
+
+type scheduledObservation struct {
+	observation operation.Observation
+	// Only one of interval and schedule is used
+	interval time.Duration
+	schedule *operation.Schedule
+	next     time.Time
+}
+
+func (sched *scheduledObservation) nextAfter(moment time.Time) time.Time {
+	if sched.schedule != nil {
+		return sched.schedule.Next(moment)
+	}
+	return moment.Add(sched.interval)
+}
+
+type agent struct {
+	// The --file values, expanded again on every reload so that
+	// new files in a spec directory get picked up
+	patterns         []string
+	default_interval time.Duration
+	opts             Options
+	spec             *operation.Operations
+	observations     map[string]*scheduledObservation
+	// Modification times of the spec files that were last loaded
+	loaded       map[string]time.Time
+	reload_error string
+	// Observations that are running right now. Only the agent loop
+	// touches this, so it doesn't need locking
+	running map[string]bool
+}
+
+func agentLog(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, time.Now().Format(time.RFC3339)+" "+format+"\n", args...)
+}
+
+// specFiles expands the spec patterns and stamps every file with
+// when it was last modified
+func specFiles(patterns []string) ([]string, map[string]time.Time, error) {
+	files, err := localdata.ChooseFilesOrStdin(patterns, false)
+	if err != nil {
+		return nil, nil, err
+	}
+	stamp := make(map[string]time.Time)
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			return nil, nil, fmt.Errorf("could not read spec file %s: %s", file, err)
+		}
+		stamp[file] = info.ModTime()
+	}
+	return files, stamp, nil
+}
+
+func sameStamp(current map[string]time.Time, loaded map[string]time.Time) bool {
+	if len(current) != len(loaded) {
+		return false
+	}
+	for file, mod_time := range current {
+		if loaded_time, found := loaded[file]; !found || !loaded_time.Equal(mod_time) {
+			return false
+		}
+	}
+	return true
+}
+
+// Specs with warnings still load, but the agent won't run a spec
+// that has errors
+func specErrors(diagnostics []operparse.Diagnostic) error {
+	messages := []string{}
+	for _, diagnostic := range diagnostics {
+		if diagnostic.Level != operparse.DIAGNOSTIC_ERROR {
+			continue
+		}
+		if diagnostic.Name != "" {
+			messages = append(messages, fmt.Sprintf("%s '%s': %s", diagnostic.Kind, diagnostic.Name, strings.TrimSpace(diagnostic.Message)))
+		} else {
+			messages = append(messages, strings.TrimSpace(diagnostic.Message))
+		}
+	}
+	if len(messages) < 1 {
+		return nil
+	}
+	return &ResultError{
+		Exit_Code: EXIT_SPEC_ERROR,
+		Message:   "spec is invalid:\n  " + strings.Join(messages, "\n  "),
+	}
+}
+
+// The agent reacts to each observation as soon as it runs, so it
+// can't keep the order between reactions to different observations.
+// Specs that ask for that are rejected instead of quietly running
+// those reactions in any order
+func crossObservationOrder(rctns map[string]operation.Reaction) error {
+	messages := []string{}
+	rctn_names := make([]string, 0, len(rctns))
+	for rctn_name := range rctns {
+		rctn_names = append(rctn_names, rctn_name)
+	}
+	sort.Strings(rctn_names)
+	for _, rctn_name := range rctn_names {
+		rctn := rctns[rctn_name]
+		check := func(field string, names []string) {
+			for _, name := range names {
+				if other, found := rctns[name]; found && other.Observation != rctn.Observation {
+					messages = append(messages, fmt.Sprintf(
+						"reaction '%s' %s '%s', which reacts to a different observation ('%s' instead of '%s')",
+						rctn_name,
+						field,
+						name,
+						other.Observation,
+						rctn.Observation,
+					))
+				}
+			}
+		}
+		check("requires", rctn.Requires)
+		check("runs before", rctn.Before)
+	}
+	if len(messages) < 1 {
+		return nil
+	}
+	return &ResultError{
+		Exit_Code: EXIT_SPEC_ERROR,
+		Message:   "spec can't run in the agent, which reacts to each observation on its own:\n  " + strings.Join(messages, "\n  "),
+	}
+}
+
+// load replaces the agent's spec. Observations that didn't change
+// keep their place in the schedule, new or changed ones with an
+// interval run straight away
+func (agt *agent) load(files []string) error {
+	sources, err := localdata.ReadFilesOrStdin(files)
+	if err != nil {
+		return err
+	}
+	err = specErrors(Validate(sources, agt.opts))
+	if err != nil {
+		return err
+	}
+	data, err := parseSpec(sources, agt.opts)
+	if err != nil {
+		return err
+	}
+	err = crossObservationOrder(data.Reactions)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	observations := make(map[string]*scheduledObservation)
+	for obsv_name, obsv := range data.Observations {
+		// Both were validated when the spec was parsed
+		interval, _ := operation.ParseInterval(obsv.Interval)
+		sched := &scheduledObservation{observation: obsv, interval: interval}
+		if obsv.Schedule != "" {
+			sched.schedule, _ = operation.ParseSchedule(obsv.Schedule)
+		} else if interval == 0 {
+			sched.interval = agt.default_interval
+		}
+		if previous, found := agt.observations[obsv_name]; found && reflect.DeepEqual(previous.observation, obsv) {
+			sched.next = previous.next
+		} else if sched.schedule != nil {
+			sched.next = sched.schedule.Next(now)
+		} else {
+			sched.next = now
+		}
+		observations[obsv_name] = sched
+	}
+	agt.spec = data
+	agt.observations = observations
+	forgetDownloads()
+	return nil
+}
+
+// reload loads the spec again when any of the files changed. A spec
+// that fails to load is logged once and the last good spec keeps
+// running
+func (agt *agent) reload() {
+	files, stamp, err := specFiles(agt.patterns)
+	if err == nil {
+		if sameStamp(stamp, agt.loaded) {
+			return
+		}
+		agt.loaded = stamp
+		err = agt.load(files)
+	}
+	if err != nil {
+		if err.Error() != agt.reload_error {
+			agentLog("Failed to reload spec, still running the last spec that loaded: %s", err)
+		}
+		agt.reload_error = err.Error()
+		return
+	}
+	agt.reload_error = ""
+	agentLog("Reloaded spec, %d observation(s) from %d file(s)", len(agt.observations), len(files))
+}
+
+// The agent reacts to each observation as soon as it runs, so only
+// the reactions to that observation run together. load already
+// rejected requires and before between reactions to different
+// observations, so nothing is lost by only keeping the ones
+// between these reactions
+func reactionsFor(obsv_name string, rctns map[string]operation.Reaction) map[string]operation.Reaction {
+	selected := make(map[string]operation.Reaction)
+	for rctn_name, rctn := range rctns {
+		if rctn.Observation == obsv_name {
+			selected[rctn_name] = rctn
+		}
+	}
+	onlySelected := func(names []string) []string {
+		kept := []string{}
+		for _, name := range names {
+			if _, found := selected[name]; found {
+				kept = append(kept, name)
+			}
+		}
+		return kept
+	}
+	for rctn_name, rctn := range selected {
+		rctn.Requires = onlySelected(rctn.Requires)
+		rctn.Before = onlySelected(rctn.Before)
+		selected[rctn_name] = rctn
+	}
+	return selected
+}
+
+func observeAndReact(obsv_name string, obsv operation.Observation, data *operation.Operations, opts Options) AgentRun {
+	run := AgentRun{Time: time.Now(), Observation: obsv_name}
+	obsv_result := RunObservation(obsv_name, obsv, data.Implements, opts)
+	obsv_results := operation.ObservationResults{
+		Observations:       map[string]operation.ObservationResult{obsv_name: obsv_result},
+		Total_Observations: 1,
+	}
+	if obsv_result.Succeeded == false {
+		obsv_results.Failed_Observations = 1
+	}
+	if obsv_result.Expected == false {
+		obsv_results.Unexpected_Observations = 1
+	}
+	rgln := *data
+	rgln.Reactions = reactionsFor(obsv_name, data.Reactions)
+	results, err := ReactTo(&rgln, obsv_results, opts)
+	if err != nil {
+		run.Results = operation.ReactionResults{
+			Reactions:               make(map[string]operation.ReactionResult),
+			Observations:            obsv_results.Observations,
+			Total_Observations:      obsv_results.Total_Observations,
+			Failed_Observations:     obsv_results.Failed_Observations,
+			Unexpected_Observations: obsv_results.Unexpected_Observations,
+		}
+		run.Error = err.Error()
+		return run
+	}
+	run.Results = *results
+	return run
+}
+
+// dispatch starts every observation that is due and isn't still
+// running from last time. At most opts.Parallelism observations
+// run at once, the rest wait their turn
+func (agt *agent) dispatch(now time.Time, slots chan struct{}, finished chan<- AgentRun) {
+	obsv_names := make([]string, 0, len(agt.observations))
+	for obsv_name := range agt.observations {
+		obsv_names = append(obsv_names, obsv_name)
+	}
+	sort.Strings(obsv_names)
+	for _, obsv_name := range obsv_names {
+		sched := agt.observations[obsv_name]
+		if sched.next.After(now) || agt.running[obsv_name] {
+			continue
+		}
+		agt.running[obsv_name] = true
+		// Keep to the same beat instead of drifting by however late
+		// the tick was, unless the observation fell behind
+		sched.next = sched.nextAfter(sched.next)
+		if !sched.next.After(now) {
+			sched.next = sched.nextAfter(now)
+		}
+		go func(obsv_name string, obsv operation.Observation, data *operation.Operations) {
+			slots <- struct{}{}
+			run := observeAndReact(obsv_name, obsv, data, agt.opts)
+			<-slots
+			finished <- run
+		}(obsv_name, sched.observation, agt.spec)
+	}
+}
+
+func (agt *agent) record(run AgentRun) {
+	delete(agt.running, run.Observation)
+	if !agt.opts.No_History {
+		history.RecordReactions(history.LocalTarget(), run.Results, agt.opts.History_Days)
+	}
+	json_output, err := json.Marshal(run)
+	if err != nil {
+		agentLog("Could not render results of observation '%s' as JSON: %s", run.Observation, err)
+		return
+	}
+	fmt.Println(string(json_output))
+}
+
+// start runs observations until a signal arrives on stop. Shutting
+// down cancels every implement and action that is still running
+// and waits for them to be killed
+func (agt *agent) start(stop <-chan os.Signal) error {
+	files, stamp, err := specFiles(agt.patterns)
+	if err != nil {
+		return err
+	}
+	err = agt.load(files)
+	if err != nil {
+		return err
+	}
+	agt.loaded = stamp
+	agentLog("Started agent, %d observation(s) from %d file(s)", len(agt.observations), len(files))
+
+	slots := make(chan struct{}, agt.opts.Parallelism)
+	finished := make(chan AgentRun)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	last_reload := time.Now()
+	agt.dispatch(time.Now(), slots, finished)
+	for {
+		select {
+		case sig := <-stop:
+			agentLog("Received %s, stopping %d running observation(s)", sig, len(agt.running))
+			localexec.CancelAll()
+			for len(agt.running) > 0 {
+				agt.record(<-finished)
+			}
+			agentLog("Stopped agent")
+			return nil
+		case run := <-finished:
+			agt.record(run)
+		case now := <-ticker.C:
+			if now.Sub(last_reload) >= AGENT_RELOAD_INTERVAL {
+				last_reload = now
+				agt.reload()
+			}
+			agt.dispatch(now, slots, finished)
+		}
+	}
+}
+
+func CLIStartAgent(patterns []string, default_interval string, opts Options) error {
+	interval, err := operation.ParseInterval(default_interval)
+	if err != nil || interval == 0 {
+		return &errtype.InvalidInput{
+			Message: fmt.Sprintf("--interval must be a duration of at least 1s, given '%s'", default_interval),
+			Origin:  nil,
+		}
+	}
+	agt := &agent{
+		patterns:         patterns,
+		default_interval: interval,
+		opts:             opts,
+		running:          make(map[string]bool),
+	}
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, os.Interrupt)
+	defer signal.Stop(stop)
+	return agt.start(stop)
+}
@@ -0,0 +1,172 @@
+package local
+
+import (
+	"fmt"
+
+	"github.com/mcdonaldseanp/clibuild/errtype"
+	"github.com/mcdonaldseanp/lookout/operation"
+)
+
+// Exit codes for every lookout command, so that observe, react and
+// run can be used as a CI gate or a monitoring check:
+//
+//	0  everything ran and nothing failed, see --fail-on
+//	1  something couldn't run: an implement or action errored, a
+//	   target couldn't be reached, or lookout itself failed
+//	2  the spec or the CLI input is invalid
+//	3  drift: observations had unexpected results
+//	4  reactions failed
+//
+// When more than one applies the highest priority code wins, in
+// the order 4, 1, 3
+const (
+	EXIT_OK               int = 0
+	EXIT_EXECUTION_FAILED int = 1
+	EXIT_SPEC_ERROR       int = 2
+	EXIT_DRIFT            int = 3
+	EXIT_REACTIONS_FAILED int = 4
+)
+
+// What makes observe, react and run exit non-zero, see --fail-on.
+// Reactions that fail count as failed for both unexpected and
+// failed, while never only exits non-zero on errors
+const (
+	FAIL_ON_UNEXPECTED string = "unexpected"
+	FAIL_ON_FAILED     string = "failed"
+	FAIL_ON_NEVER      string = "never"
+)
+
+var FAIL_ONS = []string{FAIL_ON_UNEXPECTED, FAIL_ON_FAILED, FAIL_ON_NEVER}
+
+func ValidateFailOn(fail_on string) error {
+	for _, known := range FAIL_ONS {
+		if fail_on == known {
+			return nil
+		}
+	}
+	return &errtype.InvalidInput{
+		Message: fmt.Sprintf("--fail-on must be one of unexpected, failed, never, given '%s'", fail_on),
+		Origin:  nil,
+	}
+}
+
+// ResultError is returned once results have been printed, when they
+// should still make the command exit with Exit_Code
+type ResultError struct {
+	Exit_Code int
+	Message   string
+}
+
+func (re *ResultError) Error() string {
+	return re.Message
+}
+
+var exit_priority = map[int]int{
+	EXIT_REACTIONS_FAILED: 3,
+	EXIT_EXECUTION_FAILED: 2,
+	EXIT_DRIFT:            1,
+}
+
+// WorstFailure picks the failure with the highest priority exit
+// code, for results from several targets. Any other error means
+// lookout itself failed, which wins over all of them
+func WorstFailure(failures ...error) error {
+	var worst *ResultError
+	for _, failure := range failures {
+		if failure == nil {
+			continue
+		}
+		result_err, ok := failure.(*ResultError)
+		if !ok {
+			return failure
+		}
+		if worst == nil || exit_priority[result_err.Exit_Code] > exit_priority[worst.Exit_Code] {
+			worst = result_err
+		}
+	}
+	if worst == nil {
+		return nil
+	}
+	return worst
+}
+
+// ObservationsFailure decides whether observation results should
+// fail the command
+func ObservationsFailure(failed int, unexpected int, fail_on string) error {
+	if fail_on == FAIL_ON_NEVER {
+		return nil
+	}
+	if failed > 0 {
+		return &ResultError{
+			Exit_Code: EXIT_EXECUTION_FAILED,
+			Message:   fmt.Sprintf("%d observation(s) failed to run", failed),
+		}
+	}
+	if unexpected > 0 && fail_on == FAIL_ON_UNEXPECTED {
+		return &ResultError{
+			Exit_Code: EXIT_DRIFT,
+			Message:   fmt.Sprintf("%d observation(s) had unexpected results", unexpected),
+		}
+	}
+	return nil
+}
+
+// unresolvedDrift counts the unexpected observations that no
+// reaction fixed. Drift only counts as fixed when the observation
+// ran again after a reaction and had the expected result, so
+// reactions with verify: false never fix anything
+func unresolvedDrift(results operation.ReactionResults) int {
+	fixed := make(map[string]bool)
+	for _, rctn_result := range results.Reactions {
+		if !rctn_result.Succeeded || rctn_result.Skipped || rctn_result.Planned_Action != nil {
+			continue
+		}
+		if rctn_result.Post_Observation != nil && rctn_result.Post_Observation.Expected {
+			fixed[rctn_result.Reaction.Observation] = true
+		}
+	}
+	unresolved := 0
+	for obsv_name, obsv_result := range results.Observations {
+		if obsv_result.Succeeded && !obsv_result.Expected && !fixed[obsv_name] {
+			unresolved++
+		}
+	}
+	return unresolved
+}
+
+// ReactionsFailure decides whether reaction results should fail the
+// command. Drift only counts when no reaction fixed it
+func ReactionsFailure(results operation.ReactionResults, fail_on string) error {
+	if fail_on == FAIL_ON_NEVER {
+		return nil
+	}
+	if results.Failed_Reactions > 0 {
+		return &ResultError{
+			Exit_Code: EXIT_REACTIONS_FAILED,
+			Message:   fmt.Sprintf("%d reaction(s) failed", results.Failed_Reactions),
+		}
+	}
+	return ObservationsFailure(results.Failed_Observations, unresolvedDrift(results), fail_on)
+}
+
+// ActionsFailure decides whether action results from run should
+// fail the command. Both unexpected and failed exit 1 when the
+// action failed, since an action has no expected result
+func ActionsFailure(results operation.ActionResults, fail_on string) error {
+	if fail_on == FAIL_ON_NEVER {
+		return nil
+	}
+	failed := 0
+	for _, actn_result := range results.Actions {
+		if !actn_result.Succeeded {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return &ResultError{
+			Exit_Code: EXIT_EXECUTION_FAILED,
+			Message:   fmt.Sprintf("%d action(s) failed", failed),
+		}
+	}
+	return nil
+}
@@ -1,7 +1,9 @@
 package local
 
 import (
+	"fmt"
 	"os"
+	"sync"
 
 	"github.com/mcdonaldseanp/lookout/localdata"
 	"github.com/mcdonaldseanp/lookout/operation"
@@ -10,15 +12,70 @@ import (
 
 const IMPLS_LOC string = ".lookout/impls"
 
-func DownloadImplement(impl *operation.Implement) (string, error) {
+// Observations can run concurrently, and several implements
+// can share the same source file. Each file gets its own lock so
+// that one worker doesn't truncate a file while another worker is
+// downloading or executing it, without making every implement wait
+// for the slowest download.
+//
+// Only successful downloads are remembered, along with the url they
+// came from, so a failed download is tried again the next time and
+// a file that now comes from a different url is downloaded again
+var download_lock sync.Mutex
+var file_locks map[string]*sync.Mutex = make(map[string]*sync.Mutex)
+var downloaded map[string]string = make(map[string]string)
+
+func fileLock(file_loc string) *sync.Mutex {
+	download_lock.Lock()
+	defer download_lock.Unlock()
+	if file_locks[file_loc] == nil {
+		file_locks[file_loc] = &sync.Mutex{}
+	}
+	return file_locks[file_loc]
+}
+
+// DownloadImplement downloads the source file of an implement and
+// returns where it was saved. With opts.No_Download the file has to
+// be there already, see remote.ResolveImplements
+func DownloadImplement(impl *operation.Implement, opts Options) (string, error) {
 	if len(impl.Source_Url) < 1 || len(impl.Source_File) < 1 {
 		return "", nil
 	}
+	file_loc := os.Getenv("HOME") + "/" + IMPLS_LOC + "/" + impl.Source_File
+	if opts.No_Download {
+		if _, err := os.Stat(file_loc); err != nil {
+			return "", fmt.Errorf("implement source file %s was not copied to %s", impl.Source_File, file_loc)
+		}
+		return file_loc, nil
+	}
+
+	file_lock := fileLock(file_loc)
+	file_lock.Lock()
+	defer file_lock.Unlock()
+	download_lock.Lock()
+	source_url, done := downloaded[file_loc]
+	download_lock.Unlock()
+	if done && source_url == impl.Source_Url {
+		return file_loc, nil
+	}
 	raw_data, err := remotedata.Download(impl.Source_Url)
 	if err != nil {
 		return "", err
 	}
+	err = localdata.OverwriteFile(file_loc, raw_data)
+	if err != nil {
+		return "", err
+	}
+	download_lock.Lock()
+	downloaded[file_loc] = impl.Source_Url
+	download_lock.Unlock()
+	return file_loc, nil
+}
 
-	file_loc := os.Getenv("HOME") + "/" + IMPLS_LOC + "/" + impl.Source_File
-	return file_loc, localdata.OverwriteFile(file_loc, raw_data)
+// forgetDownloads makes every implement download again the next
+// time it runs, for when the spec changes under a long running agent
+func forgetDownloads() {
+	download_lock.Lock()
+	defer download_lock.Unlock()
+	downloaded = make(map[string]string)
 }
@@ -1,118 +1,189 @@
 package local
 
 import (
-	"encoding/json"
-	"fmt"
+	"sort"
 	"strings"
+	"sync"
 
+	"github.com/mcdonaldseanp/lookout/history"
 	"github.com/mcdonaldseanp/lookout/localdata"
 	"github.com/mcdonaldseanp/lookout/localexec"
 	"github.com/mcdonaldseanp/lookout/operation"
 	"github.com/mcdonaldseanp/lookout/operparse"
+	"github.com/mcdonaldseanp/lookout/render"
 )
 
-func RunObservation(name string, obsv operation.Observation, impls map[string]operation.Implement) operation.ObservationResult {
-	entity := obsv.Entity
-	query := obsv.Query
-
-	for _, impl := range impls {
-		if impl.Observes.Query == query && impl.Observes.Entity == entity {
-			impl_file := impl.Path
-			impl_script := impl.Script
-			executable := impl.Exe
-			dwld_file, err := DownloadImplement(&impl)
-			if err != nil {
-				return operation.ObservationResult{
-					Succeeded:   false,
-					Result:      "failed to download implement",
-					Expected:    false,
-					Logs:        err.Error(),
-					Observation: obsv,
-				}
-			} else if len(dwld_file) > 0 {
-				if len(executable) > 0 {
-					impl_file = dwld_file
-				} else {
-					impl_file = ""
-					executable = dwld_file
-				}
-			}
-			args := operparse.ComputeArgs(impl.Observes.Args, obsv)
-			output, logs, cmd_err := localexec.BuildAndRunCommand(executable, impl_file, impl_script, args)
-			if cmd_err != nil {
-				return operation.ObservationResult{
-					Succeeded:   false,
-					Result:      "error: " + strings.TrimSpace(cmd_err.Error()),
-					Expected:    false,
-					Logs:        logs,
-					Observation: obsv,
-				}
-			} else {
-				result := operation.ObservationResult{
-					Succeeded:   true,
-					Result:      output,
-					Logs:        logs,
-					Observation: obsv,
-				}
-				if obsv.Expect == output || obsv.Expect == "" {
-					result.Expected = true
-				} else {
-					result.Expected = false
-				}
-				return result
-			}
+func RunObservation(name string, obsv operation.Observation, impls map[string]operation.Implement, opts Options) operation.ObservationResult {
+	_, impl := operparse.SelectImplementForObservation(obsv, impls)
+	if impl == nil {
+		return operation.ObservationResult{
+			Succeeded:   false,
+			Result:      "error: No implement found for observation '" + name + "'",
+			Observation: obsv,
 		}
 	}
-	return operation.ObservationResult{
-		Succeeded:   false,
-		Result:      "error: No implement found for observation '" + name + "'",
-		Observation: obsv,
+	impl_file := impl.Path
+	impl_script := impl.Script
+	executable := impl.Exe
+	dwld_file, err := DownloadImplement(impl, opts)
+	if err != nil {
+		return operation.ObservationResult{
+			Succeeded:   false,
+			Result:      "failed to download implement",
+			Expected:    false,
+			Logs:        err.Error(),
+			Observation: obsv,
+		}
+	} else if len(dwld_file) > 0 {
+		if len(executable) > 0 {
+			impl_file = dwld_file
+		} else {
+			impl_file = ""
+			executable = dwld_file
+		}
+	}
+	args := operparse.ComputeArgs(impl.Observes.Args, obsv)
+	output, logs, cmd_err := localexec.BuildAndRunCommand(executable, impl_file, impl_script, args, opts.timeoutFor(obsv.Timeout, impl.Timeout), opts.becomeFor(impl.Become, impl.Become_User))
+	if cmd_err != nil {
+		return operation.ObservationResult{
+			Succeeded:   false,
+			Result:      "error: " + strings.TrimSpace(cmd_err.Error()),
+			Expected:    false,
+			Logs:        logs,
+			Observation: obsv,
+		}
+	} else if impl.Observes.Output == "json" {
+		value, select_err := operparse.SelectJSON(output, obsv.Select)
+		if select_err != nil {
+			return operation.ObservationResult{
+				Succeeded:   false,
+				Result:      "error: " + select_err.Error(),
+				Expected:    false,
+				Logs:        logs,
+				Observation: obsv,
+			}
+		}
+		result := operation.ObservationResult{
+			Succeeded:   true,
+			Result:      output,
+			Value:       value,
+			Logs:        logs,
+			Observation: obsv,
+		}
+		if obsv.Select != "" {
+			result.Result = operation.RenderValue(value)
+		}
+		result.Expected = obsv.Expect.Matches(result.Result, value)
+		return result
+	} else if obsv.Select != "" {
+		return operation.ObservationResult{
+			Succeeded:   false,
+			Result:      "error: observation selects '" + obsv.Select + "' but its implement does not output json",
+			Expected:    false,
+			Logs:        logs,
+			Observation: obsv,
+		}
+	} else {
+		result := operation.ObservationResult{
+			Succeeded:   true,
+			Result:      output,
+			Logs:        logs,
+			Observation: obsv,
+		}
+		result.Expected = obsv.Expect.Matches(output, nil)
+		return result
 	}
 }
 
-func RunAllObservations(obsvs map[string]operation.Observation, impls map[string]operation.Implement) operation.ObservationResults {
+func RunAllObservations(obsvs map[string]operation.Observation, impls map[string]operation.Implement, opts Options) operation.ObservationResults {
 	results := operation.ObservationResults{Observations: make(map[string]operation.ObservationResult)}
-	for obsv_name, obsv := range obsvs {
-		this_result := RunObservation(obsv_name, obsv, impls)
-		results.Observations[obsv_name] = this_result
+	parallelism := opts.Parallelism
+	if parallelism < 1 {
+		parallelism = 1
+	}
+	// Hand out observations in sorted order so that a run with
+	// parallelism 1 always executes in the same order
+	obsv_names := make([]string, 0, len(obsvs))
+	for obsv_name := range obsvs {
+		obsv_names = append(obsv_names, obsv_name)
+	}
+	sort.Strings(obsv_names)
+
+	type named_result struct {
+		name   string
+		result operation.ObservationResult
+	}
+	jobs := make(chan string)
+	finished := make(chan named_result)
+	var workers sync.WaitGroup
+	for i := 0; i < parallelism; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for obsv_name := range jobs {
+				finished <- named_result{
+					name:   obsv_name,
+					result: RunObservation(obsv_name, obsvs[obsv_name], impls, opts),
+				}
+			}
+		}()
+	}
+	go func() {
+		for _, obsv_name := range obsv_names {
+			jobs <- obsv_name
+		}
+		close(jobs)
+		workers.Wait()
+		close(finished)
+	}()
+
+	// Only this goroutine touches results, so the totals don't
+	// need any locking no matter what order workers finish in
+	for this := range finished {
+		results.Observations[this.name] = this.result
 		results.Total_Observations++
-		if this_result.Succeeded == false {
+		if this.result.Succeeded == false {
 			results.Failed_Observations++
 		}
-		if this_result.Expected == false {
+		if this.result.Expected == false {
 			results.Unexpected_Observations++
 		}
 	}
 	return results
 }
 
-func Observe(raw_data []byte) (string, error) {
-	// No validators are required to run here because ParseOperations
-	// will use ReadFileOrStdin which performs validation on
-	// maybe_file
-	var data operation.Operations
-	parse_err := operparse.ParseOperations(raw_data, &data)
+func observe(sources []localdata.Source, opts Options) (*operation.ObservationResults, error) {
+	data, parse_err := parseSpec(sources, opts)
 	if parse_err != nil {
-		return "", parse_err
+		return nil, parse_err
+	}
+	results := RunAllObservations(data.Observations, data.Implements, opts)
+	if !opts.No_History {
+		history.RecordObservations(history.LocalTarget(), results, opts.History_Days)
 	}
-	results := RunAllObservations(data.Observations, data.Implements)
-	json_output, json_err := json.Marshal(results)
-	if json_err != nil {
-		return "", fmt.Errorf("could not render result as JSON: %s", json_err)
+	return &results, nil
+}
+
+func Observe(sources []localdata.Source, opts Options) (string, error) {
+	results, err := observe(sources, opts)
+	if err != nil {
+		return "", err
 	}
-	return string(json_output), nil
+	return render.Render(results, render.OUTPUT_JSON, false)
 }
 
-func CLIObserve(maybe_file string) error {
-	// ReadFileOrStdin performs validation on maybe_file
-	raw_data, err := localdata.ReadFileOrStdin(maybe_file)
+func CLIObserve(maybe_files []string, opts Options) error {
+	sources, err := localdata.ReadFilesOrStdin(maybe_files)
+	if err != nil {
+		return err
+	}
+	results, err := observe(sources, opts)
 	if err != nil {
 		return err
 	}
-	result, err := Observe(raw_data)
+	err = render.Print(results, opts.Output)
 	if err != nil {
 		return err
 	}
-	fmt.Printf(result)
-	return nil
+	return ObservationsFailure(results.Failed_Observations, results.Unexpected_Observations, opts.Fail_On)
 }
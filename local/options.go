@@ -0,0 +1,136 @@
+package local
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/mcdonaldseanp/clibuild/errtype"
+	"github.com/mcdonaldseanp/lookout/localdata"
+	"github.com/mcdonaldseanp/lookout/localexec"
+	"github.com/mcdonaldseanp/lookout/operation"
+	"github.com/mcdonaldseanp/lookout/render"
+)
+
+// Options that come from the CLI and apply to a whole run
+// rather than to any single operation in the spec
+type Options struct {
+	// Number of observations to run at the same time
+	Parallelism int
+	// Timeout used by any observation or action that
+	// doesn't set its own. Zero means no timeout
+	Default_Timeout time.Duration
+	// When planning, observations still run but actions
+	// never do. Reactions report the action they would
+	// have run instead
+	Plan bool
+	// Variables from --var, which win over every other
+	// source of variables
+	Vars map[string]string
+	// Use implement source files already in ~/.lookout/impls
+	// instead of downloading them. Remote commands copy them
+	// there from the controller first
+	No_Download bool
+	// How results are printed, one of render.OUTPUTS
+	Output string
+	// What makes observe, react and run exit non-zero, one of FAIL_ONS
+	Fail_On string
+	// Don't record observation and reaction results, see
+	// history.RecordReactions
+	No_History bool
+	// How many days of history to keep, zero keeps everything
+	History_Days int
+	BecomeOptions
+}
+
+// The --become flags, which remote commands pass on
+// to the lookout client on each target
+type BecomeOptions struct {
+	// Run every implement and action with sudo, not just the
+	// ones that set become in the spec
+	Become bool
+	// Who to become when the spec doesn't say, root by default
+	Become_User string
+	// Sent to sudo when it asks. Nil means sudo has to allow
+	// running without a password
+	Become_Password []byte
+}
+
+// ReadBecomePassword reads the sudo password from an environment
+// variable, a file or a prompt on the terminal. The environment
+// variable is cleared afterwards so that implements never see it
+func ReadBecomePassword(env_name string, file string, ask bool) ([]byte, error) {
+	if ask {
+		return localexec.PromptSecret("sudo password: ")
+	}
+	password, err := localdata.ReadSecret(env_name, file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read become password: %s", err)
+	}
+	if env_name != "" {
+		os.Unsetenv(env_name)
+	}
+	return password, nil
+}
+
+// Picks the timeout for a single command: the first non-empty
+// timeout from the spec wins, otherwise the CLI default is used.
+//
+// Timeouts are validated when the spec is parsed, so a parse
+// failure here falls back to the default
+func (opts Options) timeoutFor(timeouts ...string) time.Duration {
+	for _, raw := range timeouts {
+		if raw == "" {
+			continue
+		}
+		if timeout, err := operation.ParseTimeout(raw); err == nil {
+			return timeout
+		}
+	}
+	return opts.Default_Timeout
+}
+
+// becomeFor decides who a command from the spec runs as. A user
+// set in the spec wins over --become-user
+func (opts Options) becomeFor(become bool, become_user string) *localexec.Become {
+	if !become && !opts.Become {
+		return nil
+	}
+	if become_user == "" {
+		become_user = opts.Become_User
+	}
+	if become_user == "" {
+		become_user = localexec.DEFAULT_BECOME_USER
+	}
+	return &localexec.Become{User: become_user, Password: opts.Become_Password}
+}
+
+func NewOptions(parallelism int, default_timeout string, output string, fail_on string) (Options, error) {
+	timeout, err := operation.ParseTimeout(default_timeout)
+	if err != nil {
+		return Options{}, &errtype.InvalidInput{
+			Message: fmt.Sprintf("--timeout is invalid: %s", err),
+			Origin:  nil,
+		}
+	}
+	if parallelism < 1 {
+		return Options{}, &errtype.InvalidInput{
+			Message: fmt.Sprintf("--parallelism must be at least 1, given %d", parallelism),
+			Origin:  nil,
+		}
+	}
+	err = render.ValidateFormat(output)
+	if err != nil {
+		return Options{}, err
+	}
+	err = ValidateFailOn(fail_on)
+	if err != nil {
+		return Options{}, err
+	}
+	return Options{
+		Parallelism:     parallelism,
+		Default_Timeout: timeout,
+		Output:          output,
+		Fail_On:         fail_on,
+	}, nil
+}
@@ -1,17 +1,28 @@
 package local
 
 import (
-	"encoding/json"
 	"fmt"
 
+	"github.com/mcdonaldseanp/lookout/history"
 	"github.com/mcdonaldseanp/lookout/localdata"
 	"github.com/mcdonaldseanp/lookout/operation"
 	"github.com/mcdonaldseanp/lookout/operparse"
+	"github.com/mcdonaldseanp/lookout/render"
 )
 
-func runReaction(check_result bool, rctn operation.Reaction, actn_name string, actn *operation.Action, skipped_message string) operation.ReactionResult {
-	if check_result {
-		action_result := RunAction(*actn)
+func runReaction(check_result bool, rctn operation.Reaction, actn_name string, actn *operation.Action, skipped_message string, opts Options) operation.ReactionResult {
+	if check_result && opts.Plan {
+		return operation.ReactionResult{
+			Succeeded:      true,
+			Skipped:        false,
+			Output:         "",
+			Logs:           "",
+			Message:        "Plan: would run '" + actn_name + "'",
+			Reaction:       rctn,
+			Planned_Action: actn,
+		}
+	} else if check_result {
+		action_result := RunAction(*actn, opts)
 		if !action_result.Succeeded {
 			return operation.ReactionResult{
 				Succeeded: false,
@@ -43,7 +54,61 @@ func runReaction(check_result bool, rctn operation.Reaction, actn_name string, a
 	}
 }
 
-func maybeRunReaction(reaction operation.Reaction, obsv *operation.Observation, obsv_result *operation.ObservationResult, rgln *operation.Operations) operation.ReactionResult {
+// Runs the reaction's observation again once its action has run.
+// If the new observation result doesn't match what the action was
+// supposed to result in, the reaction is marked as failed.
+//
+// results_in is only used for corrections, which pass if the observation
+// returns exactly results_in or otherwise meets its expect field. Other
+// actions don't declare what they result in so they are only checked
+// against the observation's expect field
+func verifyReaction(result operation.ReactionResult, obsv operation.Observation, results_in string, rgln *operation.Operations, opts Options) operation.ReactionResult {
+	if result.Skipped || !result.Succeeded || result.Planned_Action != nil {
+		return result
+	}
+	obsv_name := result.Reaction.Observation
+	post_result := RunObservation(obsv_name, obsv, rgln.Implements, opts)
+	result.Post_Observation = &post_result
+	if post_result.Succeeded == false {
+		result.Succeeded = false
+		result.Message = fmt.Sprintf("%s, but failed to run observation '%s' again afterwards", result.Message, obsv_name)
+		return result
+	}
+	if result.Reaction.Action == "correction" {
+		result.Verified = post_result.Result == results_in || post_result.Expected
+	} else {
+		result.Verified = post_result.Expected
+	}
+	if result.Verified {
+		result.Message = fmt.Sprintf("%s, observation '%s' now has the expected result", result.Message, obsv_name)
+	} else {
+		result.Succeeded = false
+		result.Message = fmt.Sprintf(
+			"%s, but observation '%s' still did not have the expected result afterwards: got '%s'",
+			result.Message,
+			obsv_name,
+			post_result.Result,
+		)
+	}
+	return result
+}
+
+func skipMessage(cond operation.Condition) string {
+	switch cond.Check {
+	case "matches":
+		return "Skipped reaction: observation output did not match"
+	case "expected":
+		if cond.Value == true {
+			return "Skipped reaction: observation was the expected result"
+		} else {
+			return "Skipped reaction: observation was not the expected result"
+		}
+	default:
+		return "Skipped reaction: condition '" + operparse.DescribeCondition(cond) + "' was not met"
+	}
+}
+
+func maybeRunReaction(reaction operation.Reaction, obsv *operation.Observation, obsv_result *operation.ObservationResult, rgln *operation.Operations, opts Options) operation.ReactionResult {
 	if obsv == nil {
 		return operation.ReactionResult{
 			Succeeded: false,
@@ -86,12 +151,19 @@ func maybeRunReaction(reaction operation.Reaction, obsv *operation.Observation,
 				if actn != nil {
 					actn.Args = operparse.ComputeArgs(actn.Args, *obsv)
 				}
-				return runReaction(
-					obsv_result.Expected == false,
-					reaction,
-					actn_name,
-					actn,
-					"Skipped reaction: observation was the expected result",
+				return verifyReaction(
+					runReaction(
+						obsv_result.Expected == false,
+						reaction,
+						actn_name,
+						actn,
+						"Skipped reaction: observation was the expected result",
+						opts,
+					),
+					*obsv,
+					rgln.Implements[actn_name].Reacts.Corrects.Results_In,
+					rgln,
+					opts,
 				)
 			}
 		} else {
@@ -112,43 +184,46 @@ func maybeRunReaction(reaction operation.Reaction, obsv *operation.Observation,
 					Reaction:  reaction,
 				}
 			} else {
-				switch reaction.Condition.Check {
-				case "matches":
-					return runReaction(
-						obsv_result.Result == reaction.Condition.Value,
-						reaction,
-						reaction.Action,
-						actn,
-						"Skipped reaction: observation output did not match",
-					)
-				case "expected":
-					skip_msg := ""
-					if reaction.Condition.Value == true {
-						skip_msg = "Skipped reaction: observation was the expected result"
-					} else {
-						skip_msg = "Skipped reaction: observation was not the expected result"
-					}
-					return runReaction(
-						reaction.Condition.Value == obsv_result.Expected,
-						reaction,
-						reaction.Action,
-						actn,
-						skip_msg,
-					)
-				default:
+				check_result, err := operparse.EvaluateCondition(reaction.Condition, *obsv_result)
+				if err != nil {
 					return operation.ReactionResult{
 						Succeeded: false,
 						Output:    "",
-						Message:   "Error checking condition, unknown Check type '" + reaction.Condition.Check + "'",
+						Message:   "Error checking condition, " + err.Error(),
 						Reaction:  reaction,
 					}
 				}
+				result := runReaction(
+					check_result,
+					reaction,
+					reaction.Action,
+					actn,
+					skipMessage(reaction.Condition),
+					opts,
+				)
+				if reaction.Verifies() {
+					return verifyReaction(result, *obsv, "", rgln, opts)
+				}
+				return result
 			}
 		}
 	}
 }
 
-func ReactTo(rgln *operation.Operations, all_obsv_results operation.ObservationResults) (*operation.ReactionResults, error) {
+// Reactions that were skipped because their condition didn't hit
+// still count as succeeded, so only actual failures (including
+// reactions skipped because of their own failed dependency)
+// stop dependent reactions from running
+func firstFailedDependency(deps []string, finished map[string]operation.ReactionResult) string {
+	for _, dep := range deps {
+		if dep_result, found := finished[dep]; found && dep_result.Succeeded == false {
+			return dep
+		}
+	}
+	return ""
+}
+
+func ReactTo(rgln *operation.Operations, all_obsv_results operation.ObservationResults, opts Options) (*operation.ReactionResults, error) {
 	obsv_results := all_obsv_results.Observations
 	results := operation.ReactionResults{
 		Reactions:               make(map[string]operation.ReactionResult),
@@ -157,11 +232,32 @@ func ReactTo(rgln *operation.Operations, all_obsv_results operation.ObservationR
 		Failed_Observations:     all_obsv_results.Failed_Observations,
 		Unexpected_Observations: all_obsv_results.Unexpected_Observations,
 	}
-	for rctn_name, reaction := range rgln.Reactions {
-		obsv_name := reaction.Observation
-		obsv := operparse.SelectObservation(obsv_name, rgln.Observations)
-		obsv_result := operparse.SelectObservationResult(obsv_name, obsv_results)
-		this_result := maybeRunReaction(reaction, obsv, obsv_result, rgln)
+	order, err := operparse.OrderReactions(rgln.Reactions)
+	if err != nil {
+		return nil, err
+	}
+	deps, err := operparse.ReactionDependencies(rgln.Reactions)
+	if err != nil {
+		return nil, err
+	}
+	for _, rctn_name := range order {
+		reaction := rgln.Reactions[rctn_name]
+		var this_result operation.ReactionResult
+		if failed_dep := firstFailedDependency(deps[rctn_name], results.Reactions); failed_dep != "" {
+			this_result = operation.ReactionResult{
+				Succeeded: false,
+				Skipped:   true,
+				Output:    "",
+				Logs:      "",
+				Message:   "Cannot react, dependency '" + failed_dep + "' failed",
+				Reaction:  reaction,
+			}
+		} else {
+			obsv_name := reaction.Observation
+			obsv := operparse.SelectObservation(obsv_name, rgln.Observations)
+			obsv_result := operparse.SelectObservationResult(obsv_name, obsv_results)
+			this_result = maybeRunReaction(reaction, obsv, obsv_result, rgln, opts)
+		}
 		results.Reactions[rctn_name] = this_result
 		results.Total_Reactions++
 		if this_result.Succeeded == false {
@@ -174,35 +270,43 @@ func ReactTo(rgln *operation.Operations, all_obsv_results operation.ObservationR
 	return &results, nil
 }
 
-func React(raw_data []byte) (string, error) {
-	var data operation.Operations
-	parse_err := operparse.ParseOperations(raw_data, &data)
+func react(sources []localdata.Source, opts Options) (*operation.ReactionResults, error) {
+	data, parse_err := parseSpec(sources, opts)
 	if parse_err != nil {
-		return "", parse_err
+		return nil, parse_err
 	}
 
-	obsv_results := RunAllObservations(data.Observations, data.Implements)
-	results, err := ReactTo(&data, obsv_results)
+	obsv_results := RunAllObservations(data.Observations, data.Implements, opts)
+	results, err := ReactTo(data, obsv_results, opts)
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+	if !opts.No_History {
+		history.RecordReactions(history.LocalTarget(), *results, opts.History_Days)
 	}
-	json_output, json_err := json.Marshal(results)
-	if json_err != nil {
-		return "", fmt.Errorf("could not render result as JSON: %s", json_err)
+	return results, nil
+}
+
+func React(sources []localdata.Source, opts Options) (string, error) {
+	results, err := react(sources, opts)
+	if err != nil {
+		return "", err
 	}
-	return string(json_output), nil
+	return render.Render(results, render.OUTPUT_JSON, false)
 }
 
-func CLIReact(maybe_file string) error {
-	// ReadFileOrStdin performs validation on maybe_file
-	raw_data, err := localdata.ReadFileOrStdin(maybe_file)
+func CLIReact(maybe_files []string, opts Options) error {
+	sources, err := localdata.ReadFilesOrStdin(maybe_files)
+	if err != nil {
+		return err
+	}
+	results, err := react(sources, opts)
 	if err != nil {
 		return err
 	}
-	result, err := React(raw_data)
+	err = render.Print(results, opts.Output)
 	if err != nil {
 		return err
 	}
-	fmt.Printf(result)
-	return nil
+	return ReactionsFailure(*results, opts.Fail_On)
 }
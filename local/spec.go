@@ -0,0 +1,30 @@
+package local
+
+import (
+	"os"
+
+	"github.com/mcdonaldseanp/lookout/localdata"
+	"github.com/mcdonaldseanp/lookout/operation"
+	"github.com/mcdonaldseanp/lookout/operparse"
+)
+
+// specVars merges the variables a spec can use, see
+// operparse.VAR_PRECEDENCE for the order
+func specVars(data *operation.Operations, opts Options) map[string]string {
+	return operparse.MergeVars(data.Vars, operparse.EnvVars(os.Environ()), opts.Vars)
+}
+
+// Parses every source and substitutes variables. Reactions that
+// depend on each other in a cycle are rejected here, before any
+// observation runs
+func parseSpec(sources []localdata.Source, opts Options) (*operation.Operations, error) {
+	var data operation.Operations
+	err := operparse.ParseSources(sources, &data)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := operparse.OrderReactions(data.Reactions); err != nil {
+		return nil, err
+	}
+	return operparse.ApplyVars(&data, specVars(&data, opts))
+}
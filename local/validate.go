@@ -0,0 +1,113 @@
+package local
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/mcdonaldseanp/lookout/inventory"
+	"github.com/mcdonaldseanp/lookout/localdata"
+	"github.com/mcdonaldseanp/lookout/operation"
+	"github.com/mcdonaldseanp/lookout/operparse"
+)
+
+// Validate parses a spec and checks it for problems without
+// running anything. A spec that fails to parse only returns
+// the parse error, since nothing else can be checked. References
+// are checked after variables are substituted, unless some of
+// the variables are undefined
+func Validate(sources []localdata.Source, opts Options) []operparse.Diagnostic {
+	var data operation.Operations
+	parse_err := operparse.ParseSources(sources, &data)
+	if parse_err != nil {
+		return []operparse.Diagnostic{operparse.ParseDiagnostic(parse_err)}
+	}
+	return checkSpec(&data, specVars(&data, opts))
+}
+
+func checkSpec(data *operation.Operations, vars map[string]string) []operparse.Diagnostic {
+	if diagnostics := operparse.CheckVars(data, vars); len(diagnostics) > 0 {
+		return diagnostics
+	}
+	substituted, err := operparse.ApplyVars(data, vars)
+	if err != nil {
+		return []operparse.Diagnostic{operparse.ParseDiagnostic(err)}
+	}
+	return operparse.CheckReferences(substituted)
+}
+
+// ValidateHosts checks a spec once for every host, with the vars
+// each host gets from the inventory the same way remote commands
+// merge them. Problems that every host has are reported once, the
+// rest say which hosts have them
+func ValidateHosts(sources []localdata.Source, hosts []inventory.Host, opts Options) []operparse.Diagnostic {
+	if len(hosts) < 1 {
+		return Validate(sources, opts)
+	}
+	var data operation.Operations
+	parse_err := operparse.ParseSources(sources, &data)
+	if parse_err != nil {
+		return []operparse.Diagnostic{operparse.ParseDiagnostic(parse_err)}
+	}
+	found := []operparse.Diagnostic{}
+	found_on := make(map[operparse.Diagnostic][]string)
+	for _, host := range hosts {
+		vars := operparse.MergeVars(data.Vars, host.Settings.Vars, operparse.EnvVars(os.Environ()), opts.Vars)
+		for _, diagnostic := range checkSpec(&data, vars) {
+			if _, seen := found_on[diagnostic]; !seen {
+				found = append(found, diagnostic)
+			}
+			found_on[diagnostic] = append(found_on[diagnostic], host.Name)
+		}
+	}
+	diagnostics := []operparse.Diagnostic{}
+	for _, diagnostic := range found {
+		if host_names := found_on[diagnostic]; len(host_names) < len(hosts) {
+			diagnostic.Message = fmt.Sprintf("%s (on %s)", diagnostic.Message, strings.Join(host_names, ", "))
+		}
+		diagnostics = append(diagnostics, diagnostic)
+	}
+	return diagnostics
+}
+
+// CLIValidate checks the spec on its own, or with an inventory once
+// for every host in it
+func CLIValidate(maybe_files []string, inventory_file string, opts Options) error {
+	sources, err := localdata.ReadFilesOrStdin(maybe_files)
+	if err != nil {
+		return err
+	}
+	var diagnostics []operparse.Diagnostic
+	if inventory_file == "" {
+		diagnostics = Validate(sources, opts)
+	} else {
+		inv, err := inventory.Load(inventory_file)
+		if err != nil {
+			return err
+		}
+		hosts, err := inv.Select("group:" + inventory.ALL_GROUP)
+		if err != nil {
+			return err
+		}
+		diagnostics = ValidateHosts(sources, hosts, opts)
+	}
+	json_output, json_err := json.Marshal(diagnostics)
+	if json_err != nil {
+		return fmt.Errorf("could not render result as JSON: %s", json_err)
+	}
+	fmt.Print(string(json_output))
+	errors := 0
+	for _, diagnostic := range diagnostics {
+		if diagnostic.Level == operparse.DIAGNOSTIC_ERROR {
+			errors++
+		}
+	}
+	if errors > 0 {
+		return &ResultError{
+			Exit_Code: EXIT_SPEC_ERROR,
+			Message:   fmt.Sprintf("spec is invalid, found %d error(s)", errors),
+		}
+	}
+	return nil
+}
@@ -6,9 +6,6 @@ import (
 	"io"
 	"os"
 	"strings"
-
-	"github.com/mcdonaldseanp/clibuild/errtype"
-	"github.com/mcdonaldseanp/clibuild/validator"
 )
 
 const STDIN_IDENTIFIER string = "__STDIN__"
@@ -22,32 +19,6 @@ func readFromStdin() string {
 	return builder.String()
 }
 
-func ChooseFileOrStdin(specfile string, use_stdin bool) (string, error) {
-	if use_stdin {
-		if len(specfile) > 0 {
-			return "", &errtype.InvalidInput{
-				Message: "cannot specify both a file and to use stdin",
-				Origin:  nil,
-			}
-		}
-		return STDIN_IDENTIFIER, nil
-	} else {
-		// Validate that the thing is actually a file on disk before
-		// going any further
-		//
-		// Cheat a little with the validator: this function is mostly used
-		// for the CLI commands, so use a name that shows it's the flag
-		err := validator.ValidateParams(fmt.Sprintf(
-			`[{"name":"--file","value":"%s","validate":["NotEmpty","IsFile"]}]`,
-			specfile,
-		))
-		if err != nil {
-			return "", err
-		}
-		return specfile, nil
-	}
-}
-
 func ReadFileOrStdin(maybe_file string) ([]byte, error) {
 	var raw_data []byte
 	if maybe_file == STDIN_IDENTIFIER {
@@ -101,3 +72,24 @@ func OverwriteFile(location string, data []byte) error {
 	}
 	return nil
 }
+
+// ReadSecret reads a passphrase or password from the named
+// environment variable or file. Files usually end in a newline
+// which isn't part of the secret
+func ReadSecret(env_name string, file string) ([]byte, error) {
+	if env_name != "" {
+		secret, found := os.LookupEnv(env_name)
+		if !found {
+			return nil, fmt.Errorf("environment variable '%s' is not set", env_name)
+		}
+		return []byte(secret), nil
+	}
+	if file != "" {
+		raw_data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s:\n%s", file, err)
+		}
+		return []byte(strings.TrimRight(string(raw_data), "\r\n")), nil
+	}
+	return nil, nil
+}
@@ -0,0 +1,159 @@
+package localdata
+
+import (
+	"bytes"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/mcdonaldseanp/clibuild/errtype"
+)
+
+// Raw spec data along with where it was read from
+type Source struct {
+	Name string
+	Data []byte
+}
+
+// FileList is a flag.Value that can be passed more than once,
+// e.g. --file implements.yaml --file observations.yaml
+type FileList []string
+
+func (fl *FileList) String() string {
+	return strings.Join(*fl, ",")
+}
+
+func (fl *FileList) Set(value string) error {
+	*fl = append(*fl, value)
+	return nil
+}
+
+func isSpecFile(path string) bool {
+	ext := filepath.Ext(path)
+	return ext == ".yaml" || ext == ".yml"
+}
+
+// Directories are searched recursively for .yaml and .yml files, and
+// anything with glob characters is expanded. Files are returned in
+// the order given, with directory contents in lexical order
+func expandSpecPath(spec_path string) ([]string, error) {
+	matches := []string{spec_path}
+	if strings.ContainsAny(spec_path, "*?[") {
+		var err error
+		matches, err = filepath.Glob(spec_path)
+		if err != nil {
+			return nil, &errtype.InvalidInput{
+				Message: fmt.Sprintf("'--file' has an invalid pattern %s: %s", spec_path, err),
+				Origin:  nil,
+			}
+		}
+		if len(matches) < 1 {
+			return nil, &errtype.InvalidInput{
+				Message: fmt.Sprintf("'--file' pattern %s does not match any files", spec_path),
+				Origin:  nil,
+			}
+		}
+	}
+	files := []string{}
+	for _, match := range matches {
+		info, err := os.Stat(match)
+		if err != nil {
+			return nil, &errtype.InvalidInput{
+				Message: fmt.Sprintf("'--file' is not a file or directory, given %s", match),
+				Origin:  nil,
+			}
+		}
+		if !info.IsDir() {
+			files = append(files, match)
+			continue
+		}
+		err = filepath.WalkDir(match, func(path string, entry fs.DirEntry, walk_err error) error {
+			if walk_err != nil {
+				return walk_err
+			}
+			if !entry.IsDir() && isSpecFile(path) {
+				files = append(files, path)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to read directory %s:\n%s", match, err)
+		}
+	}
+	return files, nil
+}
+
+func ChooseFilesOrStdin(specfiles []string, use_stdin bool) ([]string, error) {
+	if use_stdin {
+		if len(specfiles) > 0 {
+			return nil, &errtype.InvalidInput{
+				Message: "cannot specify both a file and to use stdin",
+				Origin:  nil,
+			}
+		}
+		return []string{STDIN_IDENTIFIER}, nil
+	}
+	if len(specfiles) < 1 {
+		return nil, &errtype.InvalidInput{
+			Message: "'--file' is empty",
+			Origin:  nil,
+		}
+	}
+	files := []string{}
+	seen := make(map[string]bool)
+	for _, specfile := range specfiles {
+		expanded, err := expandSpecPath(specfile)
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range expanded {
+			if !seen[file] {
+				seen[file] = true
+				files = append(files, file)
+			}
+		}
+	}
+	if len(files) < 1 {
+		return nil, &errtype.InvalidInput{
+			Message: fmt.Sprintf("'--file' did not find any .yaml or .yml files in %s", strings.Join(specfiles, ", ")),
+			Origin:  nil,
+		}
+	}
+	return files, nil
+}
+
+func ReadFilesOrStdin(maybe_files []string) ([]Source, error) {
+	sources := []Source{}
+	for _, maybe_file := range maybe_files {
+		raw_data, err := ReadFileOrStdin(maybe_file)
+		if err != nil {
+			return nil, err
+		}
+		name := maybe_file
+		if maybe_file == STDIN_IDENTIFIER {
+			name = "stdin"
+		}
+		sources = append(sources, Source{Name: name, Data: raw_data})
+	}
+	return sources, nil
+}
+
+// JoinSources puts every source into one multi-document yaml
+// stream so that it can be sent to a remote lookout client over
+// stdin. A single source is sent as-is
+func JoinSources(sources []Source) []byte {
+	if len(sources) == 1 {
+		return sources[0].Data
+	}
+	var joined bytes.Buffer
+	for _, source := range sources {
+		joined.WriteString("---\n")
+		joined.Write(source.Data)
+		if !bytes.HasSuffix(source.Data, []byte("\n")) {
+			joined.WriteString("\n")
+		}
+	}
+	return joined.Bytes()
+}
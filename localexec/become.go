@@ -0,0 +1,90 @@
+package localexec
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"strings"
+)
+
+// The user commands become when no user is given
+const DEFAULT_BECOME_USER string = "root"
+
+// Become runs a command as another user through sudo. Without a
+// Password sudo has to be allowed to run the command without one
+type Become struct {
+	User     string
+	Password []byte
+}
+
+// wrap turns a command into the sudo command that runs it as
+// become.User, and returns what to send to sudo on stdin
+func (become *Become) wrap(command_string string, args []string) (string, []string, string) {
+	sudo_args := []string{"-u", become.User}
+	stdin := ""
+	if become.Password == nil {
+		// Fail instead of hanging on a prompt nobody can answer
+		sudo_args = append(sudo_args, "-n")
+	} else {
+		sudo_args = append(sudo_args, "-S", "-p", "")
+		stdin = string(become.Password) + "\n"
+	}
+	sudo_args = append(sudo_args, "--", command_string)
+	return "sudo", append(sudo_args, args...), stdin
+}
+
+// RunningAs names the user a command runs as, for logs. The become
+// user is looked up the same way sudo does, including the #uid form,
+// so that the log shows the account the command really ran as and
+// who became it
+func RunningAs(become *Become) string {
+	current := fmt.Sprintf("uid %d", os.Getuid())
+	if current_user, err := user.Current(); err == nil {
+		current = current_user.Username
+	}
+	if become == nil {
+		return current
+	}
+	var become_user *user.User
+	var err error
+	if uid := strings.TrimPrefix(become.User, "#"); uid != become.User {
+		become_user, err = user.LookupId(uid)
+	} else {
+		become_user, err = user.Lookup(become.User)
+	}
+	if err != nil {
+		return fmt.Sprintf("%s (not a local user) through sudo from %s", become.User, current)
+	}
+	return fmt.Sprintf("%s (uid %s) through sudo from %s", become_user.Username, become_user.Uid, current)
+}
+
+// PromptSecret asks for a password on the terminal without
+// echoing it, even when stdin is being used for a spec
+func PromptSecret(prompt string) ([]byte, error) {
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return nil, fmt.Errorf("cannot prompt for a password without a terminal:\n%s", err)
+	}
+	defer tty.Close()
+	stty := func(setting string) error {
+		stty_command := exec.Command("stty", setting)
+		stty_command.Stdin = tty
+		return stty_command.Run()
+	}
+	fmt.Fprint(tty, prompt)
+	err = stty("-echo")
+	if err != nil {
+		return nil, fmt.Errorf("failed to turn off terminal echo:\n%s", err)
+	}
+	defer func() {
+		stty("echo")
+		fmt.Fprintln(tty)
+	}()
+	line, err := bufio.NewReader(tty).ReadString('\n')
+	if err != nil {
+		return nil, fmt.Errorf("failed to read password:\n%s", err)
+	}
+	return []byte(strings.TrimRight(line, "\r\n")), nil
+}
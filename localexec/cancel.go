@@ -0,0 +1,32 @@
+package localexec
+
+import "sync"
+
+// Closed by CancelAll. Every running command waits on it alongside
+// its own timeout
+var cancelled = make(chan struct{})
+var cancel_once sync.Once
+
+// CancelAll kills every command that is running, along with any
+// processes they started, and stops new commands from starting.
+// It's meant for shutting down, nothing can run afterwards
+func CancelAll() {
+	cancel_once.Do(func() {
+		close(cancelled)
+	})
+}
+
+func isCancelled() bool {
+	select {
+	case <-cancelled:
+		return true
+	default:
+		return false
+	}
+}
+
+type cancelledError struct{}
+
+func (ce *cancelledError) Error() string {
+	return "cancelled because lookout is shutting down, killed process group"
+}
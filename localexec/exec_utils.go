@@ -7,6 +7,8 @@ import (
 	"os/exec"
 	"runtime"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/mcdonaldseanp/clibuild/errtype"
 	"github.com/mcdonaldseanp/lookout/localdata"
@@ -14,6 +16,19 @@ import (
 )
 
 func ExecReadOutput(command_string string, args ...string) (string, string, error) {
+	return ExecReadOutputWithTimeout(0, command_string, args...)
+}
+
+// ExecReadOutputWithTimeout behaves like ExecReadOutput, except that
+// when timeout is greater than zero the command (and every process
+// it started) is killed once the timeout passes.
+func ExecReadOutputWithTimeout(timeout time.Duration, command_string string, args ...string) (string, string, error) {
+	return execReadOutput(timeout, "", nil, command_string, args...)
+}
+
+// become is set for commands that sudo runs as another user, see
+// waitWithTimeout
+func execReadOutput(timeout time.Duration, stdin string, become *Become, command_string string, args ...string) (string, string, error) {
 	if runtime.GOOS == "linux" && isWinPath(command_string) {
 		translated_cmd, err := wslPathConvert(command_string)
 		if err != nil {
@@ -23,13 +38,32 @@ func ExecReadOutput(command_string string, args ...string) (string, string, erro
 	}
 	shell_command := exec.Command(command_string, args...)
 	shell_command.Env = os.Environ()
-	var stdout, stderr bytes.Buffer
+	var stdout, stderr lockedBuffer
 	shell_command.Stdout = &stdout
 	shell_command.Stderr = &stderr
-	err := shell_command.Run()
+	if len(stdin) > 0 {
+		shell_command.Stdin = strings.NewReader(stdin)
+	}
+	// Put the command in its own process group so that a timeout
+	// can kill anything the implement spawned, not just the
+	// implement itself
+	setProcessGroup(shell_command)
+	var err error
+	if isCancelled() {
+		err = &cancelledError{}
+	} else {
+		err = shell_command.Start()
+		if err == nil {
+			err = waitWithTimeout(shell_command, timeout, become)
+		}
+	}
 	output := stdout.String()
 	logs := stderr.String()
 	if err != nil {
+		switch err.(type) {
+		case *timeoutError, *cancelledError:
+			logs = logs + err.Error() + "\n"
+		}
 		return output, logs, &errtype.ShellError{
 			Message: fmt.Sprintf("Command '%s' failed:\n%s\nstderr:\n%s", shell_command, err, logs),
 			Origin:  err,
@@ -38,7 +72,102 @@ func ExecReadOutput(command_string string, args ...string) (string, string, erro
 	return output, logs, nil
 }
 
-func ExecScriptReadOutput(executable string, script string, args []string) (string, string, error) {
+type timeoutError struct {
+	timeout time.Duration
+}
+
+func (te *timeoutError) Error() string {
+	return fmt.Sprintf("timed out after %s, killed process group", te.timeout)
+}
+
+// Waits for the command to finish, killing it early if the timeout
+// passes or CancelAll is called.
+//
+// A command that sudo runs as another user can't be killed by this
+// user, only sudo itself can. Those commands get a SIGTERM first,
+// which sudo passes on, and after KILL_WAIT the group is killed
+// through sudo as the become user. That happens even when sudo
+// already exited, since whatever the command started can still be
+// running in the group
+func waitWithTimeout(shell_command *exec.Cmd, timeout time.Duration, become *Become) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- shell_command.Wait()
+	}()
+	// A nil channel never fires, so without a timeout only
+	// finishing or being cancelled ends the wait
+	var timed_out <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		timed_out = timer.C
+	}
+	var stopped error
+	select {
+	case err := <-done:
+		return err
+	case <-timed_out:
+		stopped = &timeoutError{timeout: timeout}
+	case <-cancelled:
+		stopped = &cancelledError{}
+	}
+	if become != nil {
+		terminateProcessGroup(shell_command)
+		finished := waitAtMost(done, KILL_WAIT)
+		killProcessGroupAs(become, shell_command)
+		if finished {
+			return stopped
+		}
+	}
+	killProcessGroup(shell_command)
+	// Wait for the kill to land so that stdout and stderr are done
+	// being written before they get read. A process that left the
+	// group can keep the pipes open forever though, so stop waiting
+	// after a while and leave Wait to finish whenever it does
+	waitAtMost(done, KILL_WAIT)
+	return stopped
+}
+
+// waitAtMost reports whether the command finished within wait
+func waitAtMost(done <-chan error, wait time.Duration) bool {
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-done:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// How long to wait for a killed command's output to finish, and
+// for a command run through sudo to stop after SIGTERM
+const KILL_WAIT time.Duration = 5 * time.Second
+
+// lockedBuffer collects output that can still be written to by a
+// killed command after it has been read, see waitWithTimeout
+type lockedBuffer struct {
+	lock   sync.Mutex
+	buffer bytes.Buffer
+}
+
+func (lb *lockedBuffer) Write(data []byte) (int, error) {
+	lb.lock.Lock()
+	defer lb.lock.Unlock()
+	return lb.buffer.Write(data)
+}
+
+func (lb *lockedBuffer) String() string {
+	lb.lock.Lock()
+	defer lb.lock.Unlock()
+	return lb.buffer.String()
+}
+
+func ExecScriptReadOutput(executable string, script string, args []string, timeout time.Duration) (string, string, error) {
+	return execScript(executable, script, args, timeout, nil)
+}
+
+func execScript(executable string, script string, args []string, timeout time.Duration, become *Become) (string, string, error) {
 	f, err := os.CreateTemp("", "lookout_script")
 	if err != nil {
 		return "", "", fmt.Errorf("could not create tmp file")
@@ -46,20 +175,44 @@ func ExecScriptReadOutput(executable string, script string, args []string) (stri
 	filename := f.Name()
 	defer os.Remove(filename) // clean up
 	localdata.OverwriteFile(filename, []byte(script))
+	if become != nil {
+		// Temp files are only readable by the user that made them
+		os.Chmod(filename, 0644)
+	}
 	final_args := append([]string{filename}, args...)
-	return ExecReadOutput(executable, final_args...)
+	return runAs(become, timeout, executable, final_args...)
+}
+
+// runAs runs a command as the become user, or as this user
+// when become is nil
+func runAs(become *Become, timeout time.Duration, command_string string, args ...string) (string, string, error) {
+	if become == nil {
+		return execReadOutput(timeout, "", nil, command_string, args...)
+	}
+	if runtime.GOOS == "linux" && isWinPath(command_string) {
+		translated_cmd, err := wslPathConvert(command_string)
+		if err != nil {
+			return "", "", err
+		}
+		command_string = translated_cmd
+	}
+	sudo, sudo_args, stdin := become.wrap(command_string, args)
+	return execReadOutput(timeout, stdin, become, sudo, sudo_args...)
 }
 
-func BuildAndRunCommand(executable string, file string, script string, args []string) (string, string, error) {
+// BuildAndRunCommand runs an implement or action. A timeout of zero
+// means the command is allowed to run forever, and a nil become runs
+// it as the current user
+func BuildAndRunCommand(executable string, file string, script string, args []string, timeout time.Duration, become *Become) (string, string, error) {
 	var output, logs string
 	var err error
 	if len(file) > 0 {
 		final_args := append([]string{file}, args...)
-		output, logs, err = ExecReadOutput(executable, final_args...)
+		output, logs, err = runAs(become, timeout, executable, final_args...)
 	} else if len(script) > 0 {
-		output, logs, err = ExecScriptReadOutput(executable, script, args)
+		output, logs, err = execScript(executable, script, args, timeout, become)
 	} else {
-		output, logs, err = ExecReadOutput(executable, args...)
+		output, logs, err = runAs(become, timeout, executable, args...)
 	}
 	if err != nil {
 		return output, logs, err
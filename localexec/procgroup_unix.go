@@ -0,0 +1,48 @@
+//go:build !windows
+
+package localexec
+
+import (
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+func setProcessGroup(shell_command *exec.Cmd) {
+	shell_command.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+// SIGTERM goes to sudo as well, which passes it on to the command
+// it runs, see waitWithTimeout
+func terminateProcessGroup(shell_command *exec.Cmd) {
+	if shell_command.Process == nil {
+		return
+	}
+	syscall.Kill(-shell_command.Process.Pid, syscall.SIGTERM)
+}
+
+// killProcessGroupAs kills the group through sudo as the become
+// user, which reaches the processes sudo started that this user
+// can't signal
+func killProcessGroupAs(become *Become, shell_command *exec.Cmd) {
+	if shell_command.Process == nil {
+		return
+	}
+	sudo, sudo_args, stdin := become.wrap("kill", []string{"-KILL", "--", "-" + strconv.Itoa(shell_command.Process.Pid)})
+	kill_command := exec.Command(sudo, sudo_args...)
+	kill_command.Stdin = strings.NewReader(stdin)
+	kill_command.Run()
+}
+
+// Killing the negative pid sends the signal to every
+// process in the group
+func killProcessGroup(shell_command *exec.Cmd) {
+	if shell_command.Process == nil {
+		return
+	}
+	err := syscall.Kill(-shell_command.Process.Pid, syscall.SIGKILL)
+	if err != nil {
+		shell_command.Process.Kill()
+	}
+}
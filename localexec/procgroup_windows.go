@@ -0,0 +1,36 @@
+//go:build windows
+
+package localexec
+
+import (
+	"os/exec"
+	"strconv"
+	"syscall"
+)
+
+func setProcessGroup(shell_command *exec.Cmd) {
+	shell_command.SysProcAttr = &syscall.SysProcAttr{CreationFlags: syscall.CREATE_NEW_PROCESS_GROUP}
+}
+
+// Windows doesn't have SIGTERM or sudo, so there's nothing
+// gentler than killing the whole tree
+func terminateProcessGroup(shell_command *exec.Cmd) {
+	killProcessGroup(shell_command)
+}
+
+// There's no sudo on Windows, so there's no one else to kill as
+func killProcessGroupAs(become *Become, shell_command *exec.Cmd) {
+	killProcessGroup(shell_command)
+}
+
+// Windows doesn't have process groups that can be signalled
+// the same way, so use taskkill to kill the whole tree
+func killProcessGroup(shell_command *exec.Cmd) {
+	if shell_command.Process == nil {
+		return
+	}
+	err := exec.Command("taskkill", "/T", "/F", "/PID", strconv.Itoa(shell_command.Process.Pid)).Run()
+	if err != nil {
+		shell_command.Process.Kill()
+	}
+}
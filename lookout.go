@@ -2,12 +2,20 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"os"
+	"time"
 
 	"github.com/mcdonaldseanp/clibuild/cli"
+	"github.com/mcdonaldseanp/clibuild/errtype"
+	"github.com/mcdonaldseanp/lookout/api"
+	"github.com/mcdonaldseanp/lookout/history"
 	"github.com/mcdonaldseanp/lookout/local"
 	"github.com/mcdonaldseanp/lookout/localdata"
+	"github.com/mcdonaldseanp/lookout/operparse"
 	"github.com/mcdonaldseanp/lookout/remote"
+	"github.com/mcdonaldseanp/lookout/remoteexec"
+	"github.com/mcdonaldseanp/lookout/render"
 	"github.com/mcdonaldseanp/lookout/version"
 )
 
@@ -23,24 +31,128 @@ func main() {
 	// the flag package can ignore any required commands
 	// before parsing
 	local_flag_set := flag.NewFlagSet("local_options", flag.ExitOnError)
-	local_input_file := local_flag_set.String("file", "", "Path to spec yaml file (must use one of --file or --stdin)")
+	var local_input_files localdata.FileList
+	local_flag_set.Var(&local_input_files, "file", "Path to spec yaml file, directory of yaml files or glob. Can be repeated (must use one of --file or --stdin)")
 	local_use_stdin := local_flag_set.Bool("stdin", false, "Read spec from stdin (must use one of --file or --stdin)")
+	parallelism := local_flag_set.Int("parallelism", 1, "Number of observations to run at the same time")
+	local_plan := local_flag_set.Bool("plan", false, "Run observations and show which actions would run, without running any actions")
+	var local_vars operparse.VarList
+	local_flag_set.Var(&local_vars, "var", "Set a variable used as ${{ name }} in the spec, as name=value. Can be repeated")
+	local_vars_env := local_flag_set.String("vars-env", "", "Name of an environment variable holding variables as a JSON object of names to values, used like --var. --var wins when both set a variable")
+	no_download := local_flag_set.Bool("no-download", false, "Use implement source files already in ~/.lookout/impls instead of downloading source_url")
+	local_output := local_flag_set.String("output", render.OUTPUT_JSON, "Output format: json, json-pretty, yaml, table, junit or tap")
+	local_fail_on := local_flag_set.String("fail-on", local.FAIL_ON_UNEXPECTED, "What makes observe, react and run exit non-zero: 'unexpected' exits 3 when observations have unexpected results (after reactions for react), 'failed' only when observations or actions fail to run (1) or reactions fail (4), 'never' only on errors. Invalid specs exit 2")
+	local_no_history := local_flag_set.Bool("no-history", false, "Don't record observation and reaction results in ~/.lookout/history")
+	local_history_days := local_flag_set.Int("history-days", history.DEFAULT_HISTORY_DAYS, "Number of days of results to keep in ~/.lookout/history, older days are deleted when results are recorded. 0 keeps everything")
+	local_become := becomeFlags(local_flag_set)
+	default_timeout := local_flag_set.String("timeout", "", "Default timeout for observations and actions that don't set one, e.g. 30s or 5m (default no timeout)")
 
 	remote_flag_set := flag.NewFlagSet("remote_options", flag.ExitOnError)
-	remote_input_file := remote_flag_set.String("file", "", "Path to spec yaml file (must use one of --file or --stdin)")
+	var remote_input_files localdata.FileList
+	remote_flag_set.Var(&remote_input_files, "file", "Path to spec yaml file, directory of yaml files or glob. Can be repeated (must use one of --file or --stdin)")
 	remote_use_stdin := remote_flag_set.Bool("stdin", false, "Read spec from stdin (must use one of --file or --stdin)")
-	username := remote_flag_set.String("user", os.Getenv("USER"), "Username to use when connecting via SSH")
-	port := remote_flag_set.String("port", "22", "Port to use for ssh connections")
+	remote_connection := connectionFlags(remote_flag_set)
+	remote_plan := remote_flag_set.Bool("plan", false, "Run observations on the target and show which actions would run, without running any actions")
+	concurrency := remote_flag_set.Int("concurrency", 10, "Number of targets to connect to at the same time")
+	var remote_vars operparse.VarList
+	remote_flag_set.Var(&remote_vars, "var", "Set a variable used as ${{ name }} in the spec on every target, as name=value. Can be repeated")
+	remote_output := remote_flag_set.String("output", render.OUTPUT_JSON, "Output format: json, json-pretty, yaml, table, junit or tap")
+	remote_fail_on := remote_flag_set.String("fail-on", local.FAIL_ON_UNEXPECTED, "What makes observe, react and run exit non-zero: 'unexpected' exits 3 when observations have unexpected results (after reactions for react), 'failed' only when observations or actions fail to run (1) or reactions fail (4), 'never' only on errors. Invalid specs exit 2")
+	remote_no_history := remote_flag_set.Bool("no-history", false, "Don't record the results from each target in ~/.lookout/history")
+	remote_history_days := remote_flag_set.Int("history-days", history.DEFAULT_HISTORY_DAYS, "Number of days of results to keep in ~/.lookout/history, older days are deleted when results are recorded. 0 keeps everything")
+	remote_become := becomeFlags(remote_flag_set)
+	version_check := remote_flag_set.String("version-check", remote.VERSION_CHECK_WARN, "What to do when the lookout client on a target is a different version: refuse, warn or upgrade (runs setup remote first, see --upload)")
+	remote_upload := remote_flag_set.Bool("upload", false, "With --version-check upgrade, upload the running lookout binary to targets over ssh instead of downloading a release on them")
+	remote_binary := remote_flag_set.String("binary", "", "With --version-check upgrade, path to a lookout binary to upload instead of the running one, implies --upload")
+	inventory_file := remote_flag_set.String("inventory", "", "Path to an inventory yaml file. Targets can then select hosts from it with group:NAME or globs like web*")
+
+	validate_flag_set := flag.NewFlagSet("validate_options", flag.ExitOnError)
+	var validate_input_files localdata.FileList
+	validate_flag_set.Var(&validate_input_files, "file", "Path to spec yaml file, directory of yaml files or glob. Can be repeated (must use one of --file or --stdin)")
+	validate_use_stdin := validate_flag_set.Bool("stdin", false, "Read spec from stdin (must use one of --file or --stdin)")
+	var validate_vars operparse.VarList
+	validate_flag_set.Var(&validate_vars, "var", "Set a variable used as ${{ name }} in the spec, as name=value. Can be repeated")
+	validate_inventory_file := validate_flag_set.String("inventory", "", "Path to an inventory yaml file. The spec is checked once for every host in it, with the vars each host sets")
+
+	agent_flag_set := flag.NewFlagSet("agent_options", flag.ExitOnError)
+	var agent_input_files localdata.FileList
+	agent_flag_set.Var(&agent_input_files, "file", "Path to spec yaml file, directory of yaml files or glob. Can be repeated. The spec is reloaded whenever the files change")
+	agent_interval := agent_flag_set.String("interval", local.DEFAULT_AGENT_INTERVAL, "How often to run observations that don't set an interval or schedule, e.g. 30s or 5m")
+	agent_parallelism := agent_flag_set.Int("parallelism", 4, "Number of observations to run at the same time. Observations that are due wait while this many are running")
+	agent_plan := agent_flag_set.Bool("plan", false, "Run observations and show which actions would run, without running any actions")
+	var agent_vars operparse.VarList
+	agent_flag_set.Var(&agent_vars, "var", "Set a variable used as ${{ name }} in the spec, as name=value. Can be repeated")
+	agent_no_download := agent_flag_set.Bool("no-download", false, "Use implement source files already in ~/.lookout/impls instead of downloading source_url")
+	agent_no_history := agent_flag_set.Bool("no-history", false, "Don't record observation and reaction results in ~/.lookout/history")
+	agent_history_days := agent_flag_set.Int("history-days", history.DEFAULT_HISTORY_DAYS, "Number of days of results to keep in ~/.lookout/history, older days are deleted when results are recorded. 0 keeps everything")
+	agent_become := becomeFlags(agent_flag_set)
+	agent_timeout := agent_flag_set.String("timeout", "", "Default timeout for observations and actions that don't set one, e.g. 30s or 5m (default no timeout)")
+
+	api_flag_set := flag.NewFlagSet("api_options", flag.ExitOnError)
+	api_listen := api_flag_set.String("listen", api.DEFAULT_LISTEN, "Address to listen on, as host:port")
+	api_socket := api_flag_set.String("socket", "", "Path to a unix socket to listen on instead of --listen. Only the current user can connect to it")
+	api_token_env := api_flag_set.String("token-env", "", "Name of an environment variable holding the token that requests must send as 'Authorization: Bearer TOKEN'")
+	api_token_file := api_flag_set.String("token-file", "", "Path to a file holding the token that requests must send as 'Authorization: Bearer TOKEN'")
+	api_max_request_size := api_flag_set.Int64("max-request-size", api.DEFAULT_MAX_REQUEST_SIZE, "Largest spec accepted in a request, in bytes")
+	api_parallelism := api_flag_set.Int("parallelism", 1, "Number of observations to run at the same time within a request")
+	var api_vars operparse.VarList
+	api_flag_set.Var(&api_vars, "var", "Set a variable used as ${{ name }} in every spec, as name=value. Can be repeated")
+	api_no_download := api_flag_set.Bool("no-download", false, "Use implement source files already in ~/.lookout/impls instead of downloading source_url")
+	api_no_history := api_flag_set.Bool("no-history", false, "Don't record observation and reaction results in ~/.lookout/history")
+	api_history_days := api_flag_set.Int("history-days", history.DEFAULT_HISTORY_DAYS, "Number of days of results to keep in ~/.lookout/history, older days are deleted when results are recorded. 0 keeps everything")
+	api_become := becomeFlags(api_flag_set)
+	api_timeout := api_flag_set.String("timeout", "", "Default timeout for observations and actions that don't set one, e.g. 30s or 5m (default no timeout)")
+
+	history_flag_set := flag.NewFlagSet("history_options", flag.ExitOnError)
+	history_observation := history_flag_set.String("observation", "", "Only show this observation and the reactions to it")
+	history_target := history_flag_set.String("target", "", "Only show results from this target. Results from observe local and react local are recorded under the local hostname")
+	history_since := history_flag_set.String("since", "", "Only show results from after this time, e.g. 2024-05-01T10:00:00Z, 2024-05-01, or a time ago like 90m or 7d")
+	history_until := history_flag_set.String("until", "", "Only show results from before this time, in the same formats as --since. A date on its own includes the whole day")
+	history_transitions := history_flag_set.Bool("transitions", false, "Only show results that changed from the result before them, e.g. when an observation went from expected to unexpected")
+	history_output := history_flag_set.String("output", render.OUTPUT_JSON, "Output format: json, json-pretty, yaml, table, junit or tap")
 
 	setup_flag_set := flag.NewFlagSet("setup_options", flag.ExitOnError)
-	setup_username := setup_flag_set.String("user", os.Getenv("USER"), "Username to use when connecting via SSH")
-	setup_port := setup_flag_set.String("port", "22", "Port to use for ssh connections")
+	setup_connection := connectionFlags(setup_flag_set)
+	setup_upload := setup_flag_set.Bool("upload", false, "Upload the running lookout binary to the target over ssh instead of downloading a release on the target")
+	setup_binary := setup_flag_set.String("binary", "", "Path to a lookout binary to upload instead of the running one, implies --upload")
 
 	// All CLI commands should follow naming rules of powershell approved verbs:
 	// https://docs.microsoft.com/en-us/powershell/scripting/developer/cmdlet/approved-verbs-for-windows-powershell-commands?view=powershell-7.2
 	//
 	// Also, try to keep these in alphabetical order. The list is already long enough
 	command_list := []cli.Command{
+		{
+			Verb:     "get",
+			Noun:     "history",
+			Supports: []string{"linux", "windows"},
+			ExecutionFn: func() {
+				usage := "lookout get history [FLAGS]"
+				description := "Show observation and reaction results recorded by past runs, oldest first"
+				cli.ShouldHaveArgs(0, usage, description, history_flag_set)
+				now := time.Now()
+				since, err := history.ParseTime(*history_since, now)
+				if err != nil {
+					exitWith(err, usage, description, history_flag_set)
+				}
+				until, err := history.ParseUntil(*history_until, now)
+				if err != nil {
+					exitWith(err, usage, description, history_flag_set)
+				}
+				filter := history.Filter{
+					Observation: *history_observation,
+					Target:      *history_target,
+					Since:       since,
+					Until:       until,
+					Transitions: *history_transitions,
+				}
+				exitWith(
+					history.CLIGetHistory(filter, *history_output),
+					usage,
+					description,
+					history_flag_set,
+				)
+			},
+		},
 		{
 			Verb:     "observe",
 			Noun:     "local",
@@ -49,12 +161,28 @@ func main() {
 				usage := "lookout observe local [FLAGS]"
 				description := "Run observation code on the local system and print out the resulting observations"
 				cli.ShouldHaveArgs(0, usage, description, local_flag_set)
-				input_file, err := localdata.ChooseFileOrStdin(*local_input_file, *local_use_stdin)
+				input_files, err := localdata.ChooseFilesOrStdin(local_input_files, *local_use_stdin)
+				if err != nil {
+					exitWith(err, usage, description, local_flag_set)
+				}
+				opts, err := local.NewOptions(*parallelism, *default_timeout, *local_output, *local_fail_on)
 				if err != nil {
-					cli.HandleCommandError(err, usage, description, local_flag_set)
+					exitWith(err, usage, description, local_flag_set)
 				}
-				cli.HandleCommandError(
-					local.CLIObserve(input_file),
+				opts.Plan = *local_plan
+				opts.Vars, err = localVars(local_vars, *local_vars_env)
+				if err != nil {
+					exitWith(err, usage, description, local_flag_set)
+				}
+				opts.No_Download = *no_download
+				opts.No_History = *local_no_history
+				opts.History_Days = *local_history_days
+				opts.BecomeOptions, err = local_become()
+				if err != nil {
+					exitWith(err, usage, description, local_flag_set)
+				}
+				exitWith(
+					local.CLIObserve(input_files, opts),
 					usage,
 					description,
 					local_flag_set,
@@ -66,15 +194,30 @@ func main() {
 			Noun:     "remote",
 			Supports: []string{"linux", "windows"},
 			ExecutionFn: func() {
-				usage := "lookout observe remote [TARGET] [FLAGS]"
-				description := "Run observation on a target"
+				usage := "lookout observe remote [TARGETS] [FLAGS]"
+				description := "Run observation on one or more comma separated targets or inventory selectors. A single target name prints that target's results. A list of targets, a group: selector or a glob prints the combined results keyed by target, even when it only matches one host"
 				cli.ShouldHaveArgs(1, usage, description, remote_flag_set)
-				input_file, err := localdata.ChooseFileOrStdin(*remote_input_file, *remote_use_stdin)
+				input_files, err := localdata.ChooseFilesOrStdin(remote_input_files, *remote_use_stdin)
+				if err != nil {
+					exitWith(err, usage, description, remote_flag_set)
+				}
+				opts, err := remote.NewOptions(*concurrency, *version_check, *remote_output, *remote_fail_on)
 				if err != nil {
-					cli.HandleCommandError(err, usage, description, remote_flag_set)
+					exitWith(err, usage, description, remote_flag_set)
 				}
-				cli.HandleCommandError(
-					remote.CLIObserve(input_file, *username, os.Args[3], *port),
+				opts.Plan = *remote_plan
+				opts.Inventory = *inventory_file
+				opts.Upgrade_Upload = *remote_upload || *remote_binary != ""
+				opts.Upgrade_Binary = *remote_binary
+				opts.Vars = remote_vars.Map()
+				opts.No_History = *remote_no_history
+				opts.History_Days = *remote_history_days
+				opts.BecomeOptions, err = remote_become()
+				if err != nil {
+					exitWith(err, usage, description, remote_flag_set)
+				}
+				exitWith(
+					remote.CLIObserve(input_files, os.Args[3], remote_connection(), opts),
 					usage,
 					description,
 					remote_flag_set,
@@ -89,12 +232,28 @@ func main() {
 				usage := "lookout react local [FLAGS]"
 				description := "React to an observation on the local system"
 				cli.ShouldHaveArgs(0, usage, description, local_flag_set)
-				input_file, err := localdata.ChooseFileOrStdin(*local_input_file, *local_use_stdin)
+				input_files, err := localdata.ChooseFilesOrStdin(local_input_files, *local_use_stdin)
+				if err != nil {
+					exitWith(err, usage, description, local_flag_set)
+				}
+				opts, err := local.NewOptions(*parallelism, *default_timeout, *local_output, *local_fail_on)
 				if err != nil {
-					cli.HandleCommandError(err, usage, description, local_flag_set)
+					exitWith(err, usage, description, local_flag_set)
 				}
-				cli.HandleCommandError(
-					local.CLIReact(input_file),
+				opts.Plan = *local_plan
+				opts.Vars, err = localVars(local_vars, *local_vars_env)
+				if err != nil {
+					exitWith(err, usage, description, local_flag_set)
+				}
+				opts.No_Download = *no_download
+				opts.No_History = *local_no_history
+				opts.History_Days = *local_history_days
+				opts.BecomeOptions, err = local_become()
+				if err != nil {
+					exitWith(err, usage, description, local_flag_set)
+				}
+				exitWith(
+					local.CLIReact(input_files, opts),
 					usage,
 					description,
 					local_flag_set,
@@ -106,15 +265,30 @@ func main() {
 			Noun:     "remote",
 			Supports: []string{"linux", "windows"},
 			ExecutionFn: func() {
-				usage := "lookout react remote [TARGET] [FLAGS]"
-				description := "React to an observation on a target"
+				usage := "lookout react remote [TARGETS] [FLAGS]"
+				description := "React to an observation on one or more comma separated targets or inventory selectors. A single target name prints that target's results. A list of targets, a group: selector or a glob prints the combined results keyed by target, even when it only matches one host"
 				cli.ShouldHaveArgs(1, usage, description, remote_flag_set)
-				input_file, err := localdata.ChooseFileOrStdin(*remote_input_file, *remote_use_stdin)
+				input_files, err := localdata.ChooseFilesOrStdin(remote_input_files, *remote_use_stdin)
+				if err != nil {
+					exitWith(err, usage, description, remote_flag_set)
+				}
+				opts, err := remote.NewOptions(*concurrency, *version_check, *remote_output, *remote_fail_on)
 				if err != nil {
-					cli.HandleCommandError(err, usage, description, remote_flag_set)
+					exitWith(err, usage, description, remote_flag_set)
 				}
-				cli.HandleCommandError(
-					remote.CLIReact(input_file, *username, os.Args[3], *port),
+				opts.Plan = *remote_plan
+				opts.Inventory = *inventory_file
+				opts.Upgrade_Upload = *remote_upload || *remote_binary != ""
+				opts.Upgrade_Binary = *remote_binary
+				opts.Vars = remote_vars.Map()
+				opts.No_History = *remote_no_history
+				opts.History_Days = *remote_history_days
+				opts.BecomeOptions, err = remote_become()
+				if err != nil {
+					exitWith(err, usage, description, remote_flag_set)
+				}
+				exitWith(
+					remote.CLIReact(input_files, os.Args[3], remote_connection(), opts),
 					usage,
 					description,
 					remote_flag_set,
@@ -129,12 +303,28 @@ func main() {
 				usage := "lookout run local [ACTION NAME] [FLAGS]"
 				description := "Run an action on the local system"
 				cli.ShouldHaveArgs(1, usage, description, local_flag_set)
-				input_file, err := localdata.ChooseFileOrStdin(*local_input_file, *local_use_stdin)
+				input_files, err := localdata.ChooseFilesOrStdin(local_input_files, *local_use_stdin)
 				if err != nil {
-					cli.HandleCommandError(err, usage, description, local_flag_set)
+					exitWith(err, usage, description, local_flag_set)
 				}
-				cli.HandleCommandError(
-					local.CLIRun(input_file, os.Args[3]),
+				opts, err := local.NewOptions(*parallelism, *default_timeout, *local_output, *local_fail_on)
+				if err != nil {
+					exitWith(err, usage, description, local_flag_set)
+				}
+				opts.Plan = *local_plan
+				opts.Vars, err = localVars(local_vars, *local_vars_env)
+				if err != nil {
+					exitWith(err, usage, description, local_flag_set)
+				}
+				opts.No_Download = *no_download
+				opts.No_History = *local_no_history
+				opts.History_Days = *local_history_days
+				opts.BecomeOptions, err = local_become()
+				if err != nil {
+					exitWith(err, usage, description, local_flag_set)
+				}
+				exitWith(
+					local.CLIRun(input_files, os.Args[3], opts),
 					usage,
 					description,
 					local_flag_set,
@@ -146,15 +336,30 @@ func main() {
 			Noun:     "remote",
 			Supports: []string{"linux", "windows"},
 			ExecutionFn: func() {
-				usage := "lookout run remote [ACTION NAME] [TARGET] [FLAGS]"
-				description := "Run actions on a target"
+				usage := "lookout run remote [ACTION NAME] [TARGETS] [FLAGS]"
+				description := "Run actions on one or more comma separated targets or inventory selectors. A single target name prints that target's results. A list of targets, a group: selector or a glob prints the combined results keyed by target, even when it only matches one host"
 				cli.ShouldHaveArgs(2, usage, description, remote_flag_set)
-				input_file, err := localdata.ChooseFileOrStdin(*remote_input_file, *remote_use_stdin)
+				input_files, err := localdata.ChooseFilesOrStdin(remote_input_files, *remote_use_stdin)
 				if err != nil {
-					cli.HandleCommandError(err, usage, description, remote_flag_set)
+					exitWith(err, usage, description, remote_flag_set)
 				}
-				cli.HandleCommandError(
-					remote.CLIRun(input_file, os.Args[3], *username, os.Args[4], *port),
+				opts, err := remote.NewOptions(*concurrency, *version_check, *remote_output, *remote_fail_on)
+				if err != nil {
+					exitWith(err, usage, description, remote_flag_set)
+				}
+				opts.Plan = *remote_plan
+				opts.Inventory = *inventory_file
+				opts.Upgrade_Upload = *remote_upload || *remote_binary != ""
+				opts.Upgrade_Binary = *remote_binary
+				opts.Vars = remote_vars.Map()
+				opts.No_History = *remote_no_history
+				opts.History_Days = *remote_history_days
+				opts.BecomeOptions, err = remote_become()
+				if err != nil {
+					exitWith(err, usage, description, remote_flag_set)
+				}
+				exitWith(
+					remote.CLIRun(input_files, os.Args[3], os.Args[4], remote_connection(), opts),
 					usage,
 					description,
 					remote_flag_set,
@@ -169,15 +374,185 @@ func main() {
 				usage := "lookout setup remote [TARGET] [FLAGS]"
 				description := "Run actions on a target"
 				cli.ShouldHaveArgs(1, usage, description, setup_flag_set)
-				cli.HandleCommandError(
-					remote.CLISetup(*setup_username, os.Args[3], *setup_port),
+				conn := setup_connection()
+				conn.Target = os.Args[3]
+				exitWith(
+					remote.CLISetup(conn, *setup_upload || *setup_binary != "", *setup_binary),
 					usage,
 					description,
 					setup_flag_set,
 				)
 			},
 		},
+		{
+			Verb:     "start",
+			Noun:     "agent",
+			Supports: []string{"linux", "windows"},
+			ExecutionFn: func() {
+				usage := "lookout start agent [FLAGS]"
+				description := "Keep running observations on their interval or schedule and react to them, printing a line of json for each run. Stops on SIGTERM or ctrl-c"
+				cli.ShouldHaveArgs(0, usage, description, agent_flag_set)
+				opts, err := local.NewOptions(*agent_parallelism, *agent_timeout, render.OUTPUT_JSON, local.FAIL_ON_NEVER)
+				if err != nil {
+					exitWith(err, usage, description, agent_flag_set)
+				}
+				opts.Plan = *agent_plan
+				opts.Vars = agent_vars.Map()
+				opts.No_Download = *agent_no_download
+				opts.No_History = *agent_no_history
+				opts.History_Days = *agent_history_days
+				opts.BecomeOptions, err = agent_become()
+				if err != nil {
+					exitWith(err, usage, description, agent_flag_set)
+				}
+				exitWith(
+					local.CLIStartAgent(agent_input_files, *agent_interval, opts),
+					usage,
+					description,
+					agent_flag_set,
+				)
+			},
+		},
+		{
+			Verb:     "start",
+			Noun:     "api",
+			Supports: []string{"linux", "windows"},
+			ExecutionFn: func() {
+				usage := "lookout start api [FLAGS]"
+				description := "Serve an HTTP api that runs specs sent to POST /observe, /react and /run/ACTION, and returns the last results for each from GET. Only one react or run request runs at a time, observe requests can always run. Stops on SIGTERM or ctrl-c"
+				cli.ShouldHaveArgs(0, usage, description, api_flag_set)
+				token, err := api.ReadToken(*api_token_env, *api_token_file)
+				if err != nil {
+					exitWith(err, usage, description, api_flag_set)
+				}
+				api_opts, err := api.NewOptions(*api_listen, *api_socket, token, *api_max_request_size)
+				if err != nil {
+					exitWith(err, usage, description, api_flag_set)
+				}
+				opts, err := local.NewOptions(*api_parallelism, *api_timeout, render.OUTPUT_JSON, local.FAIL_ON_NEVER)
+				if err != nil {
+					exitWith(err, usage, description, api_flag_set)
+				}
+				opts.Vars = api_vars.Map()
+				opts.No_Download = *api_no_download
+				opts.No_History = *api_no_history
+				opts.History_Days = *api_history_days
+				opts.BecomeOptions, err = api_become()
+				if err != nil {
+					exitWith(err, usage, description, api_flag_set)
+				}
+				exitWith(
+					api.Serve(opts, api_opts),
+					usage,
+					description,
+					api_flag_set,
+				)
+			},
+		},
+		{
+			Verb:     "validate",
+			Noun:     "local",
+			Supports: []string{"linux", "windows"},
+			ExecutionFn: func() {
+				usage := "lookout validate local [FLAGS]"
+				description := "Check a spec for problems without running anything and print out the problems found"
+				cli.ShouldHaveArgs(0, usage, description, validate_flag_set)
+				input_files, err := localdata.ChooseFilesOrStdin(validate_input_files, *validate_use_stdin)
+				if err != nil {
+					exitWith(err, usage, description, validate_flag_set)
+				}
+				exitWith(
+					local.CLIValidate(input_files, *validate_inventory_file, local.Options{Vars: validate_vars.Map()}),
+					usage,
+					description,
+					validate_flag_set,
+				)
+			},
+		},
 	}
 
 	cli.RunCommand("lookout", version.VERSION, command_list)
 }
+
+// connectionFlags adds the ssh connection flags to a flagset. The
+// returned function builds the connection, without a target, once
+// the flags are parsed.
+// Values from the ssh config file are only used for flags that
+// weren't set on the command line
+func connectionFlags(flag_set *flag.FlagSet) func() remoteexec.Connection {
+	username := flag_set.String("user", "", "Username to use when connecting via SSH (default User from the ssh config file, then $USER)")
+	port := flag_set.String("port", "", "Port to use for ssh connections (default Port from the ssh config file, then 22)")
+	ssh_config := flag_set.String("ssh-config", "", "Path to the ssh config file used for HostName, User, Port, IdentityFile and ProxyJump, or 'none' (default ~/.ssh/config)")
+	proxy_jump := flag_set.String("proxy-jump", "", "Comma separated jump hosts to connect through, each one [user@]host[:port], or 'none' (default ProxyJump from the ssh config file)")
+	known_hosts := flag_set.String("known-hosts", "", "Path to the known_hosts file used to verify targets (default ~/.ssh/known_hosts)")
+	host_key_check := flag_set.String("host-key-check", remoteexec.HOST_KEY_STRICT, "How to verify target host keys: 'strict' only connects to hosts in known_hosts, 'accept-new' adds unknown hosts to known_hosts on first use")
+	identity_file := flag_set.String("identity-file", "", "Private key to use for ssh connections, tried after the ssh agent (default the keys in ~/.ssh)")
+	passphrase_env := flag_set.String("identity-passphrase-env", "", "Name of an environment variable holding the passphrase for --identity-file")
+	passphrase_file := flag_set.String("identity-passphrase-file", "", "Path to a file holding the passphrase for --identity-file")
+	certificate_file := flag_set.String("certificate", "", "OpenSSH user certificate to use with --identity-file (default the identity file with -cert.pub, if it exists)")
+	password_env := flag_set.String("password-env", "", "Name of an environment variable holding the password for password and keyboard-interactive auth")
+	password_file := flag_set.String("password-file", "", "Path to a file holding the password for password and keyboard-interactive auth")
+	return func() remoteexec.Connection {
+		return remoteexec.Connection{
+			Username:         *username,
+			Port:             *port,
+			SSH_Config:       *ssh_config,
+			Proxy_Jump:       *proxy_jump,
+			Known_Hosts:      *known_hosts,
+			Host_Key_Check:   *host_key_check,
+			Identity_File:    *identity_file,
+			Passphrase_Env:   *passphrase_env,
+			Passphrase_File:  *passphrase_file,
+			Certificate_File: *certificate_file,
+			Password_Env:     *password_env,
+			Password_File:    *password_file,
+		}
+	}
+}
+
+func becomeFlags(flag_set *flag.FlagSet) func() (local.BecomeOptions, error) {
+	become := flag_set.Bool("become", false, "Run every implement and action with sudo, not just the ones that set become in the spec")
+	become_user := flag_set.String("become-user", "", "User to become when the spec doesn't set become_user (default root)")
+	password_env := flag_set.String("become-password-env", "", "Name of an environment variable holding the sudo password (default sudo must not need a password)")
+	password_file := flag_set.String("become-password-file", "", "Path to a file holding the sudo password")
+	ask_password := flag_set.Bool("ask-become-password", false, "Prompt for the sudo password on the terminal")
+	return func() (local.BecomeOptions, error) {
+		password, err := local.ReadBecomePassword(*password_env, *password_file, *ask_password)
+		if err != nil {
+			return local.BecomeOptions{}, err
+		}
+		return local.BecomeOptions{
+			Become:          *become,
+			Become_User:     *become_user,
+			Become_Password: password,
+		}, nil
+	}
+}
+
+// localVars merges the variables from --vars-env and --var,
+// which wins
+func localVars(vars operparse.VarList, env_name string) (map[string]string, error) {
+	env_vars, err := operparse.ReadVarsEnv(env_name)
+	if err != nil {
+		return nil, err
+	}
+	return operparse.MergeVars(env_vars, vars.Map()), nil
+}
+
+// exitWith works like cli.HandleCommandError, except that it exits
+// with the codes described by local.EXIT_OK and friends instead of
+// always using 1 for an error
+func exitWith(err error, usage string, description string, flag_set *flag.FlagSet) {
+	switch typed := err.(type) {
+	case *local.ResultError:
+		fmt.Fprintf(os.Stderr, "%s\n", typed)
+		os.Exit(typed.Exit_Code)
+	case *errtype.InvalidInput:
+		fmt.Fprintf(os.Stderr, "%s\nUsage:\n  %s\n\nDescription:\n  %s\n\n", typed, usage, description)
+		if flag_set != nil {
+			flag_set.PrintDefaults()
+		}
+		os.Exit(local.EXIT_SPEC_ERROR)
+	}
+	cli.HandleCommandError(err, usage, description, flag_set)
+}
@@ -0,0 +1,309 @@
+package operation
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Expectations describe what an observation should return.
+//
+// The simplest form is a plain string, which has to match the
+// observation output exactly:
+//
+//	expect: running
+//
+// Everything else uses a map with one kind of expectation:
+//
+//	expect:
+//	  trimmed: running    # matches after trimming whitespace
+//	  regex: "^run"       # matches a regular expression
+//	  one_of: [a, b]      # matches any of the list exactly
+//	  le: 5               # numeric, combine gt/ge/lt/le for ranges
+//	  value: {a: [1, 2]}  # structured, compared to JSON output
+type Expectation struct {
+	Exact   string      `yaml:"exact,omitempty" json:"exact,omitempty"`
+	Trimmed string      `yaml:"trimmed,omitempty" json:"trimmed,omitempty"`
+	Regex   string      `yaml:"regex,omitempty" json:"regex,omitempty"`
+	One_Of  []string    `yaml:"one_of,omitempty" json:"one_of,omitempty"`
+	Gt      *float64    `yaml:"gt,omitempty" json:"gt,omitempty"`
+	Ge      *float64    `yaml:"ge,omitempty" json:"ge,omitempty"`
+	Lt      *float64    `yaml:"lt,omitempty" json:"lt,omitempty"`
+	Le      *float64    `yaml:"le,omitempty" json:"le,omitempty"`
+	Value   interface{} `yaml:"value,omitempty" json:"value,omitempty"`
+}
+
+// plainExpectation doesn't have the custom marshal
+// functions, which stops them from recursing
+type plainExpectation Expectation
+
+func (expt *Expectation) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var exact string
+	if err := unmarshal(&exact); err == nil {
+		*expt = Expectation{Exact: exact}
+		return nil
+	}
+	return unmarshal((*plainExpectation)(expt))
+}
+
+// Exact expectations are written back out as plain strings so
+// that specs and results look the same as they always have
+func (expt Expectation) MarshalYAML() (interface{}, error) {
+	if expt.onlyExact() {
+		return expt.Exact, nil
+	}
+	return plainExpectation(expt), nil
+}
+
+func (expt *Expectation) UnmarshalJSON(raw_data []byte) error {
+	var exact string
+	if err := json.Unmarshal(raw_data, &exact); err == nil {
+		*expt = Expectation{Exact: exact}
+		return nil
+	}
+	return json.Unmarshal(raw_data, (*plainExpectation)(expt))
+}
+
+func (expt Expectation) MarshalJSON() ([]byte, error) {
+	if expt.onlyExact() {
+		return json.Marshal(expt.Exact)
+	}
+	// Values from yaml can have map keys that encoding/json
+	// can't handle
+	plain := plainExpectation(expt)
+	plain.Value = NormalizeValue(plain.Value)
+	return json.Marshal(plain)
+}
+
+func (expt Expectation) numeric() bool {
+	return expt.Gt != nil || expt.Ge != nil || expt.Lt != nil || expt.Le != nil
+}
+
+func (expt Expectation) kinds() []string {
+	kinds := []string{}
+	if expt.Exact != "" {
+		kinds = append(kinds, "exact")
+	}
+	if expt.Trimmed != "" {
+		kinds = append(kinds, "trimmed")
+	}
+	if expt.Regex != "" {
+		kinds = append(kinds, "regex")
+	}
+	if expt.One_Of != nil {
+		kinds = append(kinds, "one_of")
+	}
+	if expt.numeric() {
+		kinds = append(kinds, "numeric")
+	}
+	if expt.Value != nil {
+		kinds = append(kinds, "value")
+	}
+	return kinds
+}
+
+func (expt Expectation) onlyExact() bool {
+	kinds := expt.kinds()
+	return len(kinds) == 0 || (len(kinds) == 1 && kinds[0] == "exact")
+}
+
+// IsSet returns false when the observation doesn't expect anything,
+// in which case any output is the expected output. Observations
+// without an expect field have a nil expectation, so IsSet and the
+// other exported methods are safe to call on nil
+func (expt *Expectation) IsSet() bool {
+	return expt != nil && len(expt.kinds()) > 0
+}
+
+// Lower and upper bounds of a numeric expectation, and whether
+// each bound includes the number itself
+func (expt Expectation) bounds() (float64, bool, float64, bool) {
+	low, low_incl := math.Inf(-1), true
+	high, high_incl := math.Inf(1), true
+	if expt.Ge != nil {
+		low, low_incl = *expt.Ge, true
+	}
+	if expt.Gt != nil && (expt.Ge == nil || *expt.Gt >= *expt.Ge) {
+		low, low_incl = *expt.Gt, false
+	}
+	if expt.Le != nil {
+		high, high_incl = *expt.Le, true
+	}
+	if expt.Lt != nil && (expt.Le == nil || *expt.Lt <= *expt.Le) {
+		high, high_incl = *expt.Lt, false
+	}
+	return low, low_incl, high, high_incl
+}
+
+func emptyRange(low float64, low_incl bool, high float64, high_incl bool) bool {
+	return low > high || (low == high && !(low_incl && high_incl))
+}
+
+func (expt *Expectation) Validate() error {
+	if expt == nil {
+		return nil
+	}
+	kinds := expt.kinds()
+	if len(kinds) > 1 {
+		return fmt.Errorf("expect can only use one of exact, trimmed, regex, one_of, value or gt/ge/lt/le, found: %s", strings.Join(kinds, ", "))
+	}
+	if expt.Regex != "" {
+		if _, err := regexp.Compile(expt.Regex); err != nil {
+			return fmt.Errorf("expect has an invalid regex: %s", err)
+		}
+	}
+	if expt.One_Of != nil && len(expt.One_Of) < 1 {
+		return fmt.Errorf("expect one_of cannot be empty")
+	}
+	if expt.numeric() && emptyRange(expt.bounds()) {
+		return fmt.Errorf("expect numeric range %s can never match", expt)
+	}
+	return nil
+}
+
+// Matches reports whether an observation output meets the
+// expectation. Expectations are validated when they are parsed,
+// so an invalid regex never matches.
+//
+// value is the structured result of implements that output json,
+// which value expectations compare against directly. It is nil for
+// every other output, which value expectations parse instead
+func (expt *Expectation) Matches(output string, value interface{}) bool {
+	switch {
+	case !expt.IsSet():
+		return true
+	case expt.Exact != "":
+		return output == expt.Exact
+	case expt.Trimmed != "":
+		return strings.TrimSpace(output) == expt.Trimmed
+	case expt.Regex != "":
+		matcher, err := regexp.Compile(expt.Regex)
+		if err != nil {
+			return false
+		}
+		return matcher.MatchString(output)
+	case expt.One_Of != nil:
+		for _, option := range expt.One_Of {
+			if output == option {
+				return true
+			}
+		}
+		return false
+	case expt.Value != nil:
+		if value == nil {
+			value = ParseValue(output)
+		}
+		return ValuesEqual(value, expt.Value)
+	default:
+		number, err := strconv.ParseFloat(strings.TrimSpace(output), 64)
+		if err != nil {
+			return false
+		}
+		low, low_incl, high, high_incl := expt.bounds()
+		above_low := number > low || (low_incl && number == low)
+		below_high := number < high || (high_incl && number == high)
+		return above_low && below_high
+	}
+}
+
+// Outputs that meet the expectation exactly. Only exact, one_of
+// and value expectations have these
+func (expt Expectation) candidates() []string {
+	switch {
+	case expt.Exact != "":
+		return []string{expt.Exact}
+	case expt.One_Of != nil:
+		return expt.One_Of
+	case expt.Value != nil:
+		return []string{RenderValue(expt.Value)}
+	default:
+		return nil
+	}
+}
+
+// ConflictsWith reports whether no output could ever meet both
+// expectations. Conflicts are only reported when that can be proven,
+// so two different regexes are never considered conflicting
+func (expt *Expectation) ConflictsWith(other *Expectation) bool {
+	if !expt.IsSet() || !other.IsSet() {
+		return false
+	}
+	if candidates := expt.candidates(); candidates != nil {
+		return !anyMatch(candidates, other)
+	}
+	if candidates := other.candidates(); candidates != nil {
+		return !anyMatch(candidates, expt)
+	}
+	if expt.Trimmed != "" && other.Trimmed != "" {
+		return expt.Trimmed != other.Trimmed
+	}
+	// Numeric expectations ignore surrounding whitespace the same
+	// way trimmed expectations do, so they can be compared directly.
+	// A regex could always match some amount of extra whitespace
+	if expt.Trimmed != "" && other.numeric() {
+		return !other.Matches(expt.Trimmed, nil)
+	}
+	if other.Trimmed != "" && expt.numeric() {
+		return !expt.Matches(other.Trimmed, nil)
+	}
+	if expt.numeric() && other.numeric() {
+		low, low_incl, high, high_incl := expt.bounds()
+		o_low, o_low_incl, o_high, o_high_incl := other.bounds()
+		if o_low > low || (o_low == low && !o_low_incl) {
+			low, low_incl = o_low, o_low_incl
+		}
+		if o_high < high || (o_high == high && !o_high_incl) {
+			high, high_incl = o_high, o_high_incl
+		}
+		return emptyRange(low, low_incl, high, high_incl)
+	}
+	return false
+}
+
+func anyMatch(outputs []string, expt *Expectation) bool {
+	for _, output := range outputs {
+		if expt.Matches(output, nil) {
+			return true
+		}
+	}
+	return false
+}
+
+func formatNumber(number float64) string {
+	return strconv.FormatFloat(number, 'f', -1, 64)
+}
+
+func (expt *Expectation) String() string {
+	switch {
+	case !expt.IsSet():
+		return ""
+	case expt.Exact != "":
+		return expt.Exact
+	case expt.Trimmed != "":
+		return fmt.Sprintf("trimmed '%s'", expt.Trimmed)
+	case expt.Regex != "":
+		return fmt.Sprintf("regex '%s'", expt.Regex)
+	case expt.One_Of != nil:
+		return fmt.Sprintf("one of '%s'", strings.Join(expt.One_Of, "', '"))
+	case expt.Value != nil:
+		return fmt.Sprintf("value %s", RenderValue(expt.Value))
+	default:
+		parts := []string{}
+		if expt.Gt != nil {
+			parts = append(parts, "> "+formatNumber(*expt.Gt))
+		}
+		if expt.Ge != nil {
+			parts = append(parts, ">= "+formatNumber(*expt.Ge))
+		}
+		if expt.Lt != nil {
+			parts = append(parts, "< "+formatNumber(*expt.Lt))
+		}
+		if expt.Le != nil {
+			parts = append(parts, "<= "+formatNumber(*expt.Le))
+		}
+		return strings.Join(parts, " and ")
+	}
+}
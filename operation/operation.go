@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"sort"
 	"strings"
+	"time"
 
 	"github.com/mcdonaldseanp/lookout/sanitize"
 )
@@ -24,15 +25,29 @@ type Operation interface {
 // Observations
 // ---------------------------------------------------------------
 type Observation struct {
-	Entity   string `yaml:"entity" json:"entity"`
-	Query    string `yaml:"query" json:"query"`
-	Instance string `yaml:"instance" json:"instance"`
-	Expect   string `yaml:"expect,omitempty" json:"expect,omitempty"`
+	Entity   string       `yaml:"entity" json:"entity"`
+	Query    string       `yaml:"query" json:"query"`
+	Instance string       `yaml:"instance" json:"instance"`
+	Expect   *Expectation `yaml:"expect,omitempty" json:"expect,omitempty"`
+	Timeout  string       `yaml:"timeout,omitempty" json:"timeout,omitempty"`
+	// Path to a field in the implement's output. Can only be
+	// used with implements that output json
+	Select string `yaml:"select,omitempty" json:"select,omitempty"`
+	// How often the agent runs the observation, either as a go
+	// duration (interval) or a cron expression (schedule). Only
+	// one can be set, and observe/react ignore both
+	Interval string `yaml:"interval,omitempty" json:"interval,omitempty"`
+	Schedule string `yaml:"schedule,omitempty" json:"schedule,omitempty"`
 }
 
+// Value is only set for implements that output json. It holds the
+// parsed output, or the selected field if the observation selects one.
+// When a field is selected Result is the rendered field rather than
+// the raw output, so that expect and conditions check the field
 type ObservationResult struct {
 	Succeeded   bool        `yaml:"succeeded" json:"succeeded"`
 	Result      string      `yaml:"result" json:"result"`
+	Value       interface{} `yaml:"value,omitempty" json:"value,omitempty"`
 	Expected    bool        `yaml:"expected" json:"expected"`
 	Logs        string      `yaml:"logs" json:"logs"`
 	Observation Observation `yaml:"observation" json:"observation"`
@@ -43,12 +58,17 @@ type ObservationResults struct {
 	Total_Observations      int                          `yaml:"total_observations" json:"total_observations"`
 	Failed_Observations     int                          `yaml:"failed_observations" json:"failed_observations"`
 	Unexpected_Observations int                          `yaml:"unexpected_observations" json:"unexpected_observations"`
+	// Set by observe remote to the lookout version on the target
+	Remote_Version string `yaml:"remote_version,omitempty" json:"remote_version,omitempty"`
 }
 
 // Observations can only conflict if
-// 1. they expect something
-// 2. they share all fields with another observation
-//    but expect something different
+//  1. they expect something
+//  2. they share all fields with another observation
+//     but expect something different
+//
+// Expectations aren't always simple strings, so "expect something
+// different" means that no output could meet both expectations.
 //
 // This makes checking for conflicts a pain because
 // in all other cases for the other operations we want
@@ -63,10 +83,11 @@ type ObservationResults struct {
 func (obsv Observation) HashKeys() []string {
 	result := []string{}
 	// Don't even return a hash key if there is no expect field
-	if obsv.Expect != "" {
+	if obsv.Expect.IsSet() {
 		hash := "OBS" + "EN" + sanitize.ReplaceAllSpaces(obsv.Entity) +
 			"QU" + sanitize.ReplaceAllSpaces(obsv.Query) +
-			"IN" + sanitize.ReplaceAllSpaces(obsv.Instance)
+			"IN" + sanitize.ReplaceAllSpaces(obsv.Instance) +
+			"SE" + sanitize.ReplaceAllSpaces(obsv.Select)
 		result = append(result, hash)
 	}
 	return result
@@ -79,6 +100,18 @@ func (obsv Observation) Empty() error {
 		return fmt.Errorf("missing query")
 	} else if obsv.Instance == "" {
 		return fmt.Errorf("missing instance")
+	} else if _, err := ParseTimeout(obsv.Timeout); err != nil {
+		return err
+	} else if err := obsv.Expect.Validate(); err != nil {
+		return err
+	} else if obsv.Interval != "" && obsv.Schedule != "" {
+		return fmt.Errorf("only one of interval, schedule can be set")
+	} else if _, err := ParseInterval(obsv.Interval); err != nil {
+		return err
+	} else if obsv.Schedule != "" {
+		if _, err := ParseSchedule(obsv.Schedule); err != nil {
+			return err
+		}
 	}
 	return nil
 }
@@ -88,10 +121,14 @@ func (obsv Observation) Empty() error {
 // Actions
 // ---------------------------------------------------------------
 type Action struct {
-	Path   string   `yaml:"path" json:"path"`
-	Script string   `yaml:"script" json:"script"`
-	Exe    string   `yaml:"exe,omitempty" json:"exe,omitempty"`
-	Args   []string `yaml:"args,omitempty" json:"args,omitempty"`
+	Path    string   `yaml:"path" json:"path"`
+	Script  string   `yaml:"script" json:"script"`
+	Exe     string   `yaml:"exe,omitempty" json:"exe,omitempty"`
+	Args    []string `yaml:"args,omitempty" json:"args,omitempty"`
+	Timeout string   `yaml:"timeout,omitempty" json:"timeout,omitempty"`
+	// Run with sudo as Become_User, root by default
+	Become      bool   `yaml:"become,omitempty" json:"become,omitempty"`
+	Become_User string `yaml:"become_user,omitempty" json:"become_user,omitempty"`
 }
 
 type ActionResult struct {
@@ -103,6 +140,8 @@ type ActionResult struct {
 
 type ActionResults struct {
 	Actions map[string]ActionResult `json:"actions"`
+	// Set by run remote to the lookout version on the target
+	Remote_Version string `json:"remote_version,omitempty"`
 }
 
 func (actn Action) HashKeys() []string {
@@ -113,6 +152,10 @@ func (actn Action) HashKeys() []string {
 func (actn Action) Empty() error {
 	if actn.Exe == "" {
 		return fmt.Errorf("missing exe")
+	} else if _, err := ParseTimeout(actn.Timeout); err != nil {
+		return err
+	} else if actn.Become_User != "" && !actn.Become {
+		return fmt.Errorf("become_user is set without become")
 	}
 	return nil
 }
@@ -121,24 +164,56 @@ func (actn Action) Empty() error {
 
 // Reactions
 // ---------------------------------------------------------------
+// Most checks compare the observation result to Value. The
+// all, any and not checks combine the nested Conditions instead
 type Condition struct {
-	Check string      `yaml:"check" json:"check"`
-	Value interface{} `yaml:"value" json:"value"`
+	Check      string      `yaml:"check" json:"check"`
+	Value      interface{} `yaml:"value,omitempty" json:"value,omitempty"`
+	Conditions []Condition `yaml:"conditions,omitempty" json:"conditions,omitempty"`
 }
 
+// Reactions can be ordered against each other:
+//
+// * Requires lists reactions that must run before this one
+// * Before lists reactions that must run after this one
+//
+// Either way, if a reaction fails then every reaction that
+// depends on it is skipped
 type Reaction struct {
 	Observation string    `yaml:"observation" json:"observation"`
 	Action      string    `yaml:"action" json:"action"`
 	Condition   Condition `yaml:"condition" json:"condition"`
+	Requires    []string  `yaml:"requires,omitempty" json:"requires,omitempty"`
+	Before      []string  `yaml:"before,omitempty" json:"before,omitempty"`
+	// Every action that runs is verified by running the observation
+	// again afterwards, and the reaction fails if the observation is
+	// still not the expected result. Setting verify to false skips
+	// that for actions that aren't meant to fix the observation, like
+	// sending a notification. Corrections are always verified
+	Verify *bool `yaml:"verify,omitempty" json:"verify,omitempty"`
+}
+
+// Verifies reports whether the observation should run again after
+// the reaction's action
+func (rctn Reaction) Verifies() bool {
+	return rctn.Action == "correction" || rctn.Verify == nil || *rctn.Verify
 }
 
+// Post_Observation and Verified are only set when the observation
+// was run again after the reaction's action.
+//
+// Planned_Action is only set in plan mode, and holds the fully
+// resolved action that would have run
 type ReactionResult struct {
-	Succeeded bool     `yaml:"succeeded" json:"succeeded"`
-	Skipped   bool     `yaml:"skipped" json:"skipped"`
-	Output    string   `yaml:"output" json:"output"`
-	Logs      string   `yaml:"logs" json:"logs"`
-	Message   string   `yaml:"message" json:"message"`
-	Reaction  Reaction `yaml:"reaction" json:"reaction"`
+	Succeeded        bool               `yaml:"succeeded" json:"succeeded"`
+	Skipped          bool               `yaml:"skipped" json:"skipped"`
+	Output           string             `yaml:"output" json:"output"`
+	Logs             string             `yaml:"logs" json:"logs"`
+	Message          string             `yaml:"message" json:"message"`
+	Reaction         Reaction           `yaml:"reaction" json:"reaction"`
+	Post_Observation *ObservationResult `yaml:"post_observation,omitempty" json:"post_observation,omitempty"`
+	Verified         bool               `yaml:"verified,omitempty" json:"verified,omitempty"`
+	Planned_Action   *Action            `yaml:"planned_action,omitempty" json:"planned_action,omitempty"`
 }
 
 type ReactionResults struct {
@@ -150,6 +225,8 @@ type ReactionResults struct {
 	Total_Reactions         int                          `yaml:"total_reactions" json:"total_reactions"`
 	Failed_Reactions        int                          `yaml:"failed_reactions" json:"failed_reactions"`
 	Skipped_Reactions       int                          `yaml:"skipped_reactions" json:"skipped_reactions"`
+	// Set by react remote to the lookout version on the target
+	Remote_Version string `yaml:"remote_version,omitempty" json:"remote_version,omitempty"`
 }
 
 func (rctn Reaction) HashKeys() []string {
@@ -167,6 +244,16 @@ func (rctn Reaction) Empty() error {
 	} else if rctn.Condition.Value == "" {
 		return fmt.Errorf("missing condition value")
 	}
+	for _, rqrd := range rctn.Requires {
+		if rqrd == "" {
+			return fmt.Errorf("empty reaction name in requires")
+		}
+	}
+	for _, bfr := range rctn.Before {
+		if bfr == "" {
+			return fmt.Errorf("empty reaction name in before")
+		}
+	}
 	return nil
 }
 
@@ -186,10 +273,12 @@ type ReactionImplement struct {
 	Args     []string   `yaml:"args" json:"args"`
 }
 
+// Output is either "text" (the default) or "json"
 type ObservationImplement struct {
 	Entity string   `yaml:"entity" json:"entity"`
 	Query  string   `yaml:"query" json:"query"`
 	Args   []string `yaml:"args" json:"args"`
+	Output string   `yaml:"output,omitempty" json:"output,omitempty"`
 }
 
 type Implement struct {
@@ -200,6 +289,11 @@ type Implement struct {
 	Source_Url  string               `yaml:"source_url,omitempty" json:"source_url,omitempty"`
 	Reacts      ReactionImplement    `yaml:"reacts,omitempty" json:"reacts,omitempty"`
 	Observes    ObservationImplement `yaml:"observes,omitempty" json:"observes,omitempty"`
+	Timeout     string               `yaml:"timeout,omitempty" json:"timeout,omitempty"`
+	// Observing and reacting both run with sudo as Become_User,
+	// root by default
+	Become      bool   `yaml:"become,omitempty" json:"become,omitempty"`
+	Become_User string `yaml:"become_user,omitempty" json:"become_user,omitempty"`
 }
 
 func emptyObserves(impl Implement) bool {
@@ -286,11 +380,58 @@ func (impl Implement) Empty() error {
 	if emptyReacts(impl) && emptyObserves(impl) {
 		return fmt.Errorf("missing at least one of reacts, observes")
 	}
+	if _, err := ParseTimeout(impl.Timeout); err != nil {
+		return err
+	}
+	if impl.Become_User != "" && !impl.Become {
+		return fmt.Errorf("become_user is set without become")
+	}
+	if impl.Observes.Output != "" && impl.Observes.Output != "text" && impl.Observes.Output != "json" {
+		return fmt.Errorf("unknown observes output '%s', must be one of: text, json", impl.Observes.Output)
+	}
 	return nil
 }
 
 // ---------------------------------------------------------------
 
+// Timeouts and intervals
+// ---------------------------------------------------------------
+
+// Timeouts are written as go duration strings, e.g. "30s" or "5m".
+// An empty timeout parses to zero, which means no timeout
+func ParseTimeout(raw string) (time.Duration, error) {
+	if raw == "" {
+		return 0, nil
+	}
+	timeout, err := time.ParseDuration(raw)
+	if err != nil {
+		return 0, fmt.Errorf("invalid timeout '%s': %s", raw, err)
+	}
+	if timeout < 0 {
+		return 0, fmt.Errorf("invalid timeout '%s': cannot be negative", raw)
+	}
+	return timeout, nil
+}
+
+// Intervals are go duration strings like timeouts, but can't be
+// shorter than a second. An empty interval parses to zero, which
+// means the agent's default interval is used
+func ParseInterval(raw string) (time.Duration, error) {
+	if raw == "" {
+		return 0, nil
+	}
+	interval, err := time.ParseDuration(raw)
+	if err != nil {
+		return 0, fmt.Errorf("invalid interval '%s': %s", raw, err)
+	}
+	if interval < time.Second {
+		return 0, fmt.Errorf("invalid interval '%s': must be at least 1s", raw)
+	}
+	return interval, nil
+}
+
+// ---------------------------------------------------------------
+
 // Everything together
 // ---------------------------------------------------------------
 type Operations struct {
@@ -298,4 +439,47 @@ type Operations struct {
 	Observations map[string]Observation `yaml:"observations,omitempty" json:"observations,omitempty"`
 	Implements   map[string]Implement   `yaml:"implements,omitempty" json:"implements,omitempty"`
 	Actions      map[string]Action      `yaml:"actions,omitempty" json:"actions,omitempty"`
+	// Default values for variables used as ${{ name }}, see
+	// operparse.ApplyVars
+	Vars map[string]string `yaml:"vars,omitempty" json:"vars,omitempty"`
+	// Where each operation was read from, keyed by SourceKey.
+	// Only used for error messages, so it is never rendered
+	Sources map[string]string `yaml:"-" json:"-"`
+}
+
+func SourceKey(kind string, name string) string {
+	return kind + "/" + name
+}
+
+func (ops *Operations) SourceOf(kind string, name string) string {
+	return ops.Sources[SourceKey(kind, name)]
+}
+
+func (ops *Operations) AddSource(kind string, name string, source string) {
+	if source == "" {
+		return
+	}
+	if ops.Sources == nil {
+		ops.Sources = make(map[string]string)
+	}
+	ops.Sources[SourceKey(kind, name)] = source
+}
+
+// Marks every operation as coming from source
+func (ops *Operations) SetSource(source string) {
+	for name := range ops.Observations {
+		ops.AddSource("observation", name, source)
+	}
+	for name := range ops.Reactions {
+		ops.AddSource("reaction", name, source)
+	}
+	for name := range ops.Actions {
+		ops.AddSource("action", name, source)
+	}
+	for name := range ops.Implements {
+		ops.AddSource("implement", name, source)
+	}
+	for name := range ops.Vars {
+		ops.AddSource("variable", name, source)
+	}
 }
@@ -0,0 +1,156 @@
+package operation
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedules are standard 5 field cron expressions:
+//
+//	minute hour day-of-month month day-of-week
+//
+// Each field can be *, a number, a range like 1-5, a step like */15
+// or 1-30/5, or a comma separated list of any of those. Day of week
+// runs from 0 (Sunday) to 6, and 7 is also Sunday. Like cron, when
+// both day fields are restricted a time matches if either one does
+type Schedule struct {
+	minutes  map[int]bool
+	hours    map[int]bool
+	days     map[int]bool
+	months   map[int]bool
+	weekdays map[int]bool
+	// Whether the day fields were *, which makes them not count
+	// when the other day field is restricted
+	any_day     bool
+	any_weekday bool
+}
+
+type scheduleField struct {
+	name string
+	min  int
+	max  int
+}
+
+var schedule_fields = []scheduleField{
+	{name: "minute", min: 0, max: 59},
+	{name: "hour", min: 0, max: 23},
+	{name: "day of month", min: 1, max: 31},
+	{name: "month", min: 1, max: 12},
+	{name: "day of week", min: 0, max: 7},
+}
+
+func parseScheduleValue(raw string, field scheduleField) (int, error) {
+	value, err := strconv.Atoi(raw)
+	if err != nil {
+		return 0, fmt.Errorf("%s '%s' is not a number", field.name, raw)
+	}
+	if value < field.min || value > field.max {
+		return 0, fmt.Errorf("%s %d must be between %d and %d", field.name, value, field.min, field.max)
+	}
+	return value, nil
+}
+
+func parseScheduleField(raw string, field scheduleField) (map[int]bool, error) {
+	values := make(map[int]bool)
+	for _, part := range strings.Split(raw, ",") {
+		step := 1
+		if range_part, raw_step, found := strings.Cut(part, "/"); found {
+			var err error
+			step, err = strconv.Atoi(raw_step)
+			if err != nil || step < 1 {
+				return nil, fmt.Errorf("%s step '%s' must be a number greater than 0", field.name, raw_step)
+			}
+			part = range_part
+		}
+		start, end := field.min, field.max
+		if part != "*" {
+			raw_start, raw_end, is_range := strings.Cut(part, "-")
+			var err error
+			start, err = parseScheduleValue(raw_start, field)
+			if err != nil {
+				return nil, err
+			}
+			end = start
+			if is_range {
+				end, err = parseScheduleValue(raw_end, field)
+				if err != nil {
+					return nil, err
+				}
+				if end < start {
+					return nil, fmt.Errorf("%s range '%s' ends before it starts", field.name, part)
+				}
+			} else if step > 1 {
+				// 5/15 means every 15 starting from 5
+				end = field.max
+			}
+		}
+		for value := start; value <= end; value += step {
+			values[value] = true
+		}
+	}
+	return values, nil
+}
+
+func ParseSchedule(raw string) (*Schedule, error) {
+	fields := strings.Fields(raw)
+	if len(fields) != len(schedule_fields) {
+		return nil, fmt.Errorf("invalid schedule '%s': must have 5 fields (minute hour day-of-month month day-of-week)", raw)
+	}
+	parsed := make([]map[int]bool, len(fields))
+	for index, field := range fields {
+		values, err := parseScheduleField(field, schedule_fields[index])
+		if err != nil {
+			return nil, fmt.Errorf("invalid schedule '%s': %s", raw, err)
+		}
+		parsed[index] = values
+	}
+	if parsed[4][7] {
+		parsed[4][0] = true
+	}
+	sched := &Schedule{
+		minutes:     parsed[0],
+		hours:       parsed[1],
+		days:        parsed[2],
+		months:      parsed[3],
+		weekdays:    parsed[4],
+		any_day:     fields[2] == "*",
+		any_weekday: fields[4] == "*",
+	}
+	if sched.Next(time.Now()).IsZero() {
+		return nil, fmt.Errorf("invalid schedule '%s': never matches any date", raw)
+	}
+	return sched, nil
+}
+
+func (sched *Schedule) matchesDay(moment time.Time) bool {
+	day_match := sched.days[moment.Day()]
+	weekday_match := sched.weekdays[int(moment.Weekday())]
+	if sched.any_day || sched.any_weekday {
+		return day_match && weekday_match
+	}
+	return day_match || weekday_match
+}
+
+// Next returns the first minute after the given time that matches
+// the schedule, or the zero time if nothing matches in the next
+// five years (e.g. "0 0 31 2 *")
+func (sched *Schedule) Next(after time.Time) time.Time {
+	moment := after.Truncate(time.Minute).Add(time.Minute)
+	give_up := moment.AddDate(5, 0, 0)
+	for moment.Before(give_up) {
+		if !sched.months[int(moment.Month())] {
+			moment = time.Date(moment.Year(), moment.Month()+1, 1, 0, 0, 0, 0, moment.Location())
+		} else if !sched.matchesDay(moment) {
+			moment = time.Date(moment.Year(), moment.Month(), moment.Day()+1, 0, 0, 0, 0, moment.Location())
+		} else if !sched.hours[moment.Hour()] {
+			moment = time.Date(moment.Year(), moment.Month(), moment.Day(), moment.Hour()+1, 0, 0, 0, moment.Location())
+		} else if !sched.minutes[moment.Minute()] {
+			moment = moment.Add(time.Minute)
+		} else {
+			return moment
+		}
+	}
+	return time.Time{}
+}
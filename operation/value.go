@@ -0,0 +1,71 @@
+package operation
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+)
+
+// Structured values come from two places: JSON output from implements
+// and YAML in specs. YAML maps decode with interface{} keys and numbers
+// decode as ints, so NormalizeValue converts a value to the same
+// types encoding/json would have produced to make them comparable
+func NormalizeValue(value interface{}) interface{} {
+	switch typed := value.(type) {
+	case map[interface{}]interface{}:
+		normalized := make(map[string]interface{})
+		for key, item := range typed {
+			normalized[fmt.Sprint(key)] = NormalizeValue(item)
+		}
+		return normalized
+	case map[string]interface{}:
+		normalized := make(map[string]interface{})
+		for key, item := range typed {
+			normalized[key] = NormalizeValue(item)
+		}
+		return normalized
+	case []interface{}:
+		normalized := make([]interface{}, len(typed))
+		for index, item := range typed {
+			normalized[index] = NormalizeValue(item)
+		}
+		return normalized
+	case int:
+		return float64(typed)
+	case int64:
+		return float64(typed)
+	case uint64:
+		return float64(typed)
+	default:
+		return value
+	}
+}
+
+// RenderValue turns a structured value into an observation result
+// string. Strings are used as-is so that selecting a string field
+// gives the same result a plain text implement would, everything
+// else is rendered as compact JSON
+func RenderValue(value interface{}) string {
+	if str, ok := value.(string); ok {
+		return str
+	}
+	rendered, err := json.Marshal(NormalizeValue(value))
+	if err != nil {
+		return fmt.Sprint(value)
+	}
+	return string(rendered)
+}
+
+// ParseValue is the opposite of RenderValue: output that isn't
+// valid JSON is treated as a plain string
+func ParseValue(output string) interface{} {
+	var value interface{}
+	if err := json.Unmarshal([]byte(output), &value); err != nil {
+		return output
+	}
+	return value
+}
+
+func ValuesEqual(first interface{}, second interface{}) bool {
+	return reflect.DeepEqual(NormalizeValue(first), NormalizeValue(second))
+}
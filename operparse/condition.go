@@ -0,0 +1,228 @@
+package operparse
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/mcdonaldseanp/lookout/operation"
+)
+
+// Every check a reaction condition can use. Conditions are validated
+// against this list when they are parsed so that a typo fails
+// before anything runs
+var CONDITION_CHECKS []string = []string{
+	"matches",
+	"not_matches",
+	"regex",
+	"contains",
+	"expected",
+	"gt",
+	"lt",
+	"between",
+	"in",
+	"all",
+	"any",
+	"not",
+}
+
+func isScalar(value interface{}) bool {
+	switch value.(type) {
+	case string, bool, int, int64, uint64, float64:
+		return true
+	default:
+		return false
+	}
+}
+
+// Condition values can be any yaml scalar, but observation results
+// are always strings, so values are compared as strings
+func valueString(value interface{}) string {
+	if str, ok := value.(string); ok {
+		return str
+	}
+	return fmt.Sprint(value)
+}
+
+func toNumber(value interface{}) (float64, error) {
+	switch typed := value.(type) {
+	case int:
+		return float64(typed), nil
+	case int64:
+		return float64(typed), nil
+	case uint64:
+		return float64(typed), nil
+	case float64:
+		return typed, nil
+	case string:
+		number, err := strconv.ParseFloat(strings.TrimSpace(typed), 64)
+		if err != nil {
+			return 0, fmt.Errorf("'%s' is not a number", typed)
+		}
+		return number, nil
+	default:
+		return 0, fmt.Errorf("'%v' is not a number", value)
+	}
+}
+
+func toList(value interface{}) ([]interface{}, bool) {
+	list, ok := value.([]interface{})
+	return list, ok
+}
+
+func ValidateCondition(cond operation.Condition) error {
+	switch cond.Check {
+	case "matches", "not_matches", "contains":
+		if !isScalar(cond.Value) {
+			return fmt.Errorf("check '%s' requires a single value", cond.Check)
+		}
+	case "regex":
+		pattern, ok := cond.Value.(string)
+		if !ok {
+			return fmt.Errorf("check 'regex' requires a string value")
+		}
+		if _, err := regexp.Compile(pattern); err != nil {
+			return fmt.Errorf("check 'regex' has an invalid pattern: %s", err)
+		}
+	case "expected":
+		if _, ok := cond.Value.(bool); !ok {
+			return fmt.Errorf("check 'expected' requires a value of true or false")
+		}
+	case "gt", "lt":
+		if _, err := toNumber(cond.Value); err != nil {
+			return fmt.Errorf("check '%s' requires a number: %s", cond.Check, err)
+		}
+	case "between":
+		bounds, ok := toList(cond.Value)
+		if !ok || len(bounds) != 2 {
+			return fmt.Errorf("check 'between' requires a list of two numbers")
+		}
+		low, err := toNumber(bounds[0])
+		if err != nil {
+			return fmt.Errorf("check 'between' requires a list of two numbers: %s", err)
+		}
+		high, err := toNumber(bounds[1])
+		if err != nil {
+			return fmt.Errorf("check 'between' requires a list of two numbers: %s", err)
+		}
+		if low > high {
+			return fmt.Errorf("check 'between' requires the lower number first")
+		}
+	case "in":
+		options, ok := toList(cond.Value)
+		if !ok || len(options) < 1 {
+			return fmt.Errorf("check 'in' requires a list of values")
+		}
+		for _, option := range options {
+			if !isScalar(option) {
+				return fmt.Errorf("check 'in' requires a list of single values")
+			}
+		}
+	case "all", "any", "not":
+		if cond.Value != nil {
+			return fmt.Errorf("check '%s' uses conditions, not a value", cond.Check)
+		}
+		if len(cond.Conditions) < 1 {
+			return fmt.Errorf("check '%s' requires at least one nested condition", cond.Check)
+		}
+		if cond.Check == "not" && len(cond.Conditions) != 1 {
+			return fmt.Errorf("check 'not' requires exactly one nested condition")
+		}
+		for _, nested := range cond.Conditions {
+			if err := ValidateCondition(nested); err != nil {
+				return err
+			}
+		}
+		return nil
+	case "":
+		return fmt.Errorf("missing condition check")
+	default:
+		return fmt.Errorf("unknown condition check '%s', must be one of: %s", cond.Check, strings.Join(CONDITION_CHECKS, ", "))
+	}
+	if len(cond.Conditions) > 0 {
+		return fmt.Errorf("check '%s' cannot have nested conditions", cond.Check)
+	}
+	return nil
+}
+
+// Decides whether a reaction should run based on an observation result.
+//
+// Conditions are validated at parse time, so errors here only come
+// from the observation result itself, e.g. a numeric check against
+// an observation that didn't return a number
+func EvaluateCondition(cond operation.Condition, obsv_result operation.ObservationResult) (bool, error) {
+	switch cond.Check {
+	case "matches":
+		return obsv_result.Result == valueString(cond.Value), nil
+	case "not_matches":
+		return obsv_result.Result != valueString(cond.Value), nil
+	case "regex":
+		return regexp.MustCompile(cond.Value.(string)).MatchString(obsv_result.Result), nil
+	case "contains":
+		return strings.Contains(obsv_result.Result, valueString(cond.Value)), nil
+	case "expected":
+		return cond.Value == obsv_result.Expected, nil
+	case "gt", "lt", "between":
+		result, err := toNumber(obsv_result.Result)
+		if err != nil {
+			return false, fmt.Errorf("check '%s' needs a numeric observation result: %s", cond.Check, err)
+		}
+		switch cond.Check {
+		case "gt":
+			value, _ := toNumber(cond.Value)
+			return result > value, nil
+		case "lt":
+			value, _ := toNumber(cond.Value)
+			return result < value, nil
+		default:
+			bounds, _ := toList(cond.Value)
+			low, _ := toNumber(bounds[0])
+			high, _ := toNumber(bounds[1])
+			return result >= low && result <= high, nil
+		}
+	case "in":
+		options, _ := toList(cond.Value)
+		for _, option := range options {
+			if obsv_result.Result == valueString(option) {
+				return true, nil
+			}
+		}
+		return false, nil
+	case "all", "any":
+		for _, nested := range cond.Conditions {
+			nested_result, err := EvaluateCondition(nested, obsv_result)
+			if err != nil {
+				return false, err
+			}
+			if cond.Check == "any" && nested_result {
+				return true, nil
+			} else if cond.Check == "all" && !nested_result {
+				return false, nil
+			}
+		}
+		return cond.Check == "all", nil
+	case "not":
+		nested_result, err := EvaluateCondition(cond.Conditions[0], obsv_result)
+		if err != nil {
+			return false, err
+		}
+		return !nested_result, nil
+	default:
+		return false, fmt.Errorf("unknown Check type '%s'", cond.Check)
+	}
+}
+
+// Human readable version of a condition for reaction messages
+func DescribeCondition(cond operation.Condition) string {
+	switch cond.Check {
+	case "all", "any", "not":
+		nested := []string{}
+		for _, nested_cond := range cond.Conditions {
+			nested = append(nested, DescribeCondition(nested_cond))
+		}
+		return fmt.Sprintf("%s(%s)", cond.Check, strings.Join(nested, ", "))
+	default:
+		return fmt.Sprintf("%s %v", cond.Check, cond.Value)
+	}
+}
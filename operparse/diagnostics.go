@@ -0,0 +1,164 @@
+package operparse
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/mcdonaldseanp/clibuild/errtype"
+	"github.com/mcdonaldseanp/lookout/operation"
+)
+
+const (
+	DIAGNOSTIC_ERROR   string = "error"
+	DIAGNOSTIC_WARNING string = "warning"
+)
+
+// Diagnostics describe problems with a spec that would only show
+// up once the spec is run. Kind is the type of operation with the
+// problem (observation, reaction, etc.) and Name is its name
+type Diagnostic struct {
+	Level   string `yaml:"level" json:"level"`
+	Kind    string `yaml:"kind" json:"kind"`
+	Name    string `yaml:"name" json:"name"`
+	Message string `yaml:"message" json:"message"`
+}
+
+func sortedNames[T any](ops map[string]T) []string {
+	names := make([]string, 0, len(ops))
+	for name := range ops {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func SelectImplementForObservation(obsv operation.Observation, impls map[string]operation.Implement) (string, *operation.Implement) {
+	for impl_name, impl := range impls {
+		if impl.Observes.Query == obsv.Query && impl.Observes.Entity == obsv.Entity {
+			return impl_name, &impl
+		}
+	}
+	return "", nil
+}
+
+func selectImplementForCorrection(obsv operation.Observation, impls map[string]operation.Implement) *operation.Implement {
+	for _, impl := range impls {
+		if impl.Reacts.Corrects.Entity == obsv.Entity &&
+			impl.Reacts.Corrects.Query == obsv.Query &&
+			obsv.Expect.IsSet() &&
+			obsv.Expect.Matches(impl.Reacts.Corrects.Results_In, nil) {
+			return &impl
+		}
+	}
+	return nil
+}
+
+// CheckReferences looks for problems between operations in a parsed
+// spec, like a reaction that uses an observation that doesn't exist.
+//
+// ParseOperations can't catch these since specs can be merged from
+// multiple sources, so the operations being referenced may not have
+// been parsed yet
+func CheckReferences(data *operation.Operations) []Diagnostic {
+	diagnostics := []Diagnostic{}
+	for _, obsv_name := range sortedNames(data.Observations) {
+		obsv := data.Observations[obsv_name]
+		_, impl := SelectImplementForObservation(obsv, data.Implements)
+		if impl == nil {
+			diagnostics = append(diagnostics, Diagnostic{
+				Level:   DIAGNOSTIC_ERROR,
+				Kind:    "observation",
+				Name:    obsv_name,
+				Message: fmt.Sprintf("no implement observes entity '%s' with query '%s'", obsv.Entity, obsv.Query),
+			})
+		} else if obsv.Select != "" && impl.Observes.Output != "json" {
+			diagnostics = append(diagnostics, Diagnostic{
+				Level:   DIAGNOSTIC_ERROR,
+				Kind:    "observation",
+				Name:    obsv_name,
+				Message: fmt.Sprintf("selects '%s' but its implement does not output json", obsv.Select),
+			})
+		}
+	}
+	for _, rctn_name := range sortedNames(data.Reactions) {
+		rctn := data.Reactions[rctn_name]
+		obsv := SelectObservation(rctn.Observation, data.Observations)
+		if obsv == nil {
+			diagnostics = append(diagnostics, Diagnostic{
+				Level:   DIAGNOSTIC_ERROR,
+				Kind:    "reaction",
+				Name:    rctn_name,
+				Message: fmt.Sprintf("observation '%s' does not match any existing observation names", rctn.Observation),
+			})
+		}
+		if rctn.Action == "correction" {
+			if obsv != nil && !obsv.Expect.IsSet() {
+				diagnostics = append(diagnostics, Diagnostic{
+					Level:   DIAGNOSTIC_ERROR,
+					Kind:    "reaction",
+					Name:    rctn_name,
+					Message: fmt.Sprintf("uses a correction but observation '%s' does not expect anything", rctn.Observation),
+				})
+			} else if obsv != nil && selectImplementForCorrection(*obsv, data.Implements) == nil {
+				diagnostics = append(diagnostics, Diagnostic{
+					Level:   DIAGNOSTIC_WARNING,
+					Kind:    "reaction",
+					Name:    rctn_name,
+					Message: fmt.Sprintf("no implement can correct entity '%s' with query '%s' to %s", obsv.Entity, obsv.Query, obsv.Expect),
+				})
+			}
+		} else if SelectAction(rctn.Action, data.Actions) == nil {
+			if impl, found := data.Implements[rctn.Action]; !found {
+				diagnostics = append(diagnostics, Diagnostic{
+					Level:   DIAGNOSTIC_ERROR,
+					Kind:    "reaction",
+					Name:    rctn_name,
+					Message: fmt.Sprintf("action '%s' does not match any existing action or implement names", rctn.Action),
+				})
+			} else if impl.Reacts.Args == nil {
+				diagnostics = append(diagnostics, Diagnostic{
+					Level:   DIAGNOSTIC_ERROR,
+					Kind:    "reaction",
+					Name:    rctn_name,
+					Message: fmt.Sprintf("implement '%s' cannot react", rctn.Action),
+				})
+			}
+		}
+		if err := ValidateCondition(rctn.Condition); err != nil {
+			diagnostics = append(diagnostics, Diagnostic{
+				Level:   DIAGNOSTIC_ERROR,
+				Kind:    "reaction",
+				Name:    rctn_name,
+				Message: fmt.Sprintf("invalid condition: %s", err),
+			})
+		}
+	}
+	if _, err := OrderReactions(data.Reactions); err != nil {
+		diagnostics = append(diagnostics, Diagnostic{
+			Level:   DIAGNOSTIC_ERROR,
+			Kind:    "reactions",
+			Name:    "",
+			Message: errorMessage(err),
+		})
+	}
+	return diagnostics
+}
+
+// InvalidInput errors print with an "invalid input" header and a
+// trace, which doesn't read well inside a diagnostic
+func errorMessage(err error) string {
+	if invalid, ok := err.(*errtype.InvalidInput); ok {
+		return invalid.Message
+	}
+	return err.Error()
+}
+
+// ParseDiagnostic turns an error from ParseOperations into a diagnostic
+func ParseDiagnostic(err error) Diagnostic {
+	return Diagnostic{
+		Level:   DIAGNOSTIC_ERROR,
+		Kind:    "spec",
+		Name:    "",
+		Message: errorMessage(err),
+	}
+}
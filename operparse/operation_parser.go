@@ -1,9 +1,15 @@
 package operparse
 
 import (
+	"bytes"
 	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strings"
 
 	"github.com/mcdonaldseanp/clibuild/errtype"
+	"github.com/mcdonaldseanp/lookout/localdata"
 	"github.com/mcdonaldseanp/lookout/operation"
 	"gopkg.in/yaml.v2"
 )
@@ -14,23 +20,86 @@ var RESERVED_INSTANCE_NAME string = "__obsv_instance__"
 // struct. Can be used more than once to read data from multiple
 // sources
 func ParseOperations(raw_data []byte, data *operation.Operations) error {
-	unmarshald_data := operation.Operations{}
-	err := yaml.UnmarshalStrict(raw_data, &unmarshald_data)
-	if err != nil {
-		return fmt.Errorf("failed to parse yaml:\n%s", err)
+	return ParseSource(raw_data, "", data)
+}
+
+// ParseSource is ParseOperations for data that came from somewhere
+// with a name, like a file. The name is used in error messages so
+// that conflicts between sources say where each side came from.
+//
+// The data can contain multiple yaml documents separated by "---",
+// which are merged the same way separate sources are
+func ParseSource(raw_data []byte, source string, data *operation.Operations) error {
+	decoder := yaml.NewDecoder(bytes.NewReader(raw_data))
+	decoder.SetStrict(true)
+	for {
+		unmarshald_data := operation.Operations{}
+		err := decoder.Decode(&unmarshald_data)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			// A spec that isn't valid yaml is bad input like any
+			// other invalid spec
+			message := fmt.Sprintf("failed to parse yaml:\n%s", err)
+			if source != "" {
+				message = fmt.Sprintf("failed to parse yaml in %s:\n%s", source, err)
+			}
+			return &errtype.InvalidInput{
+				Message: message,
+				Origin:  err,
+			}
+		}
+		unmarshald_data.SetSource(source)
+		err = ConcatOperations(data, &unmarshald_data)
+		if err != nil {
+			return err
+		}
 	}
-	err = ConcatOperations(data, &unmarshald_data)
-	if err != nil {
-		return err
+	return nil
+}
+
+func ParseSources(sources []localdata.Source, data *operation.Operations) error {
+	for _, source := range sources {
+		err := ParseSource(source.Data, source.Name, data)
+		if err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
+// Names an operation in error messages, including where it
+// came from if that's known
+func describe(ops *operation.Operations, kind string, name string) string {
+	source := ops.SourceOf(kind, name)
+	if source == "" {
+		return "'" + name + "'"
+	}
+	return fmt.Sprintf("'%s' (%s)", name, source)
+}
+
+func nameCollision(first *operation.Operations, second *operation.Operations, kind string, name string) error {
+	return &errtype.InvalidInput{
+		Message: fmt.Sprintf(
+			"%s %s has the same name as %s, but they are not the same",
+			strings.ToUpper(kind[:1])+kind[1:],
+			describe(second, kind, name),
+			describe(first, kind, name),
+		),
+		Origin: nil,
+	}
+}
+
 // Yeah this is big and ugly and could probably have helper functions,
 // but I don't want to do that much interface magic and pass enough
 // strings around to make the messages different and helpful.
+//
+// Operations with the same name are only allowed if they are exactly
+// the same, so that merging the same data twice is harmless but two
+// sources can't silently overwrite each other
 func ConcatOperations(first *operation.Operations, second *operation.Operations) error {
-	var conflicts map[string]string = make(map[string]string)
+	var conflicts map[string][]string = make(map[string][]string)
 	if first.Observations == nil {
 		first.Observations = make(map[string]operation.Observation)
 	}
@@ -43,94 +112,190 @@ func ConcatOperations(first *operation.Operations, second *operation.Operations)
 	if first.Implements == nil {
 		first.Implements = make(map[string]operation.Implement)
 	}
+	if first.Vars == nil {
+		first.Vars = make(map[string]string)
+	}
+	// Seed the conflicts with everything that was already merged so
+	// that conflicts between sources are caught, not just conflicts
+	// inside of second
+	for obsv_name, obsv := range first.Observations {
+		for _, key := range obsv.HashKeys() {
+			conflicts[key] = append(conflicts[key], obsv_name)
+		}
+	}
+	for rctn_name, rctn := range first.Reactions {
+		for _, key := range rctn.HashKeys() {
+			conflicts[key] = append(conflicts[key], rctn_name)
+		}
+	}
+	for actn_name, actn := range first.Actions {
+		for _, key := range actn.HashKeys() {
+			conflicts[key] = append(conflicts[key], actn_name)
+		}
+	}
+	for impl_name, impl := range first.Implements {
+		for _, key := range impl.HashKeys() {
+			conflicts[key] = append(conflicts[key], impl_name)
+		}
+	}
 	for obsv_name, obsv := range second.Observations {
 		obs_err := obsv.Empty()
 		if obs_err != nil {
 			return &errtype.InvalidInput{
-				Message: fmt.Sprintf("Observation '%s' is invalid: %s", obsv_name, obs_err),
+				Message: fmt.Sprintf("Observation %s is invalid: %s", describe(second, "observation", obsv_name), obs_err),
+				Origin:  nil,
+			}
+		}
+		select_err := ValidateSelectPath(obsv.Select)
+		if select_err != nil {
+			return &errtype.InvalidInput{
+				Message: fmt.Sprintf("Observation %s is invalid: %s", describe(second, "observation", obsv_name), select_err),
 				Origin:  nil,
 			}
 		}
+		if existing, found := first.Observations[obsv_name]; found {
+			if !reflect.DeepEqual(existing, obsv) {
+				return nameCollision(first, second, "observation", obsv_name)
+			}
+			continue
+		}
 		for _, key := range obsv.HashKeys() {
-			if conflict, conflicted := conflicts[key]; conflicted == true {
-				// When observations have a collision that's not necessarily
-				// a conflict, we have to check if the expect field is different.
-				//
-				// If the field _is_ different then there is a conflict, otherwise
-				// it's fine. In the case where they are the same we don't need to
-				// add this latest observation to the conflicts map because
-				// there's already a matching hash there
-				if first.Observations[conflict].Expect != obsv.Expect {
+			// When observations have a collision that's not necessarily
+			// a conflict, we have to check if the expect fields contradict
+			// each other. Expect fields aren't transitive (e.g. a regex
+			// can agree with two different exact values), so the new
+			// observation is checked against every observation that
+			// shares the key, and is added to them afterwards
+			for _, conflict := range conflicts[key] {
+				if first.Observations[conflict].Expect.ConflictsWith(obsv.Expect) {
 					return &errtype.InvalidInput{
-						Message: fmt.Sprintf("Observation '%s' conflicts with '%s'", obsv_name, conflict),
-						Origin:  nil,
+						Message: fmt.Sprintf(
+							"Observation %s conflicts with %s",
+							describe(second, "observation", obsv_name),
+							describe(first, "observation", conflict),
+						),
+						Origin: nil,
 					}
 				}
-			} else {
-				conflicts[key] = obsv_name
 			}
+			conflicts[key] = append(conflicts[key], obsv_name)
 		}
 		first.Observations[obsv_name] = obsv
+		first.AddSource("observation", obsv_name, second.SourceOf("observation", obsv_name))
 	}
 	for rctn_name, rctn := range second.Reactions {
 		rctn_err := rctn.Empty()
 		if rctn_err != nil {
 			return &errtype.InvalidInput{
-				Message: fmt.Sprintf("Reaction '%s' is invalid: %s", rctn_name, rctn_err),
+				Message: fmt.Sprintf("Reaction %s is invalid: %s", describe(second, "reaction", rctn_name), rctn_err),
+				Origin:  nil,
+			}
+		}
+		cond_err := ValidateCondition(rctn.Condition)
+		if cond_err != nil {
+			return &errtype.InvalidInput{
+				Message: fmt.Sprintf("Reaction %s has an invalid condition: %s", describe(second, "reaction", rctn_name), cond_err),
 				Origin:  nil,
 			}
 		}
+		if existing, found := first.Reactions[rctn_name]; found {
+			if !reflect.DeepEqual(existing, rctn) {
+				return nameCollision(first, second, "reaction", rctn_name)
+			}
+			continue
+		}
 		for _, key := range rctn.HashKeys() {
 			if conflict, conflicted := conflicts[key]; conflicted == true {
 				return &errtype.InvalidInput{
-					Message: fmt.Sprintf("Reaction '%s' conflicts with '%s'", rctn_name, conflict),
-					Origin:  nil,
+					Message: fmt.Sprintf(
+						"Reaction %s conflicts with %s",
+						describe(second, "reaction", rctn_name),
+						describe(first, "reaction", conflict[0]),
+					),
+					Origin: nil,
 				}
 			} else {
-				conflicts[key] = rctn_name
+				conflicts[key] = append(conflicts[key], rctn_name)
 			}
 		}
 		first.Reactions[rctn_name] = rctn
+		first.AddSource("reaction", rctn_name, second.SourceOf("reaction", rctn_name))
 	}
 	for actn_name, actn := range second.Actions {
 		actn_err := actn.Empty()
 		if actn_err != nil {
 			return &errtype.InvalidInput{
-				Message: fmt.Sprintf("Action '%s' is invalid: %s", actn_name, actn_err),
+				Message: fmt.Sprintf("Action %s is invalid: %s", describe(second, "action", actn_name), actn_err),
 				Origin:  nil,
 			}
 		}
+		if existing, found := first.Actions[actn_name]; found {
+			if !reflect.DeepEqual(existing, actn) {
+				return nameCollision(first, second, "action", actn_name)
+			}
+			continue
+		}
 		for _, key := range actn.HashKeys() {
 			if conflict, conflicted := conflicts[key]; conflicted == true {
 				return &errtype.InvalidInput{
-					Message: fmt.Sprintf("Action '%s' conflicts with '%s'", actn_name, conflict),
-					Origin:  nil,
+					Message: fmt.Sprintf(
+						"Action %s conflicts with %s",
+						describe(second, "action", actn_name),
+						describe(first, "action", conflict[0]),
+					),
+					Origin: nil,
 				}
 			} else {
-				conflicts[key] = actn_name
+				conflicts[key] = append(conflicts[key], actn_name)
 			}
 		}
 		first.Actions[actn_name] = actn
+		first.AddSource("action", actn_name, second.SourceOf("action", actn_name))
 	}
 	for impl_name, impl := range second.Implements {
 		impl_err := impl.Empty()
 		if impl_err != nil {
 			return &errtype.InvalidInput{
-				Message: fmt.Sprintf("Implement '%s' is invalid, %s", impl_name, impl_err),
+				Message: fmt.Sprintf("Implement %s is invalid, %s", describe(second, "implement", impl_name), impl_err),
 				Origin:  nil,
 			}
 		}
+		if existing, found := first.Implements[impl_name]; found {
+			if !reflect.DeepEqual(existing, impl) {
+				return nameCollision(first, second, "implement", impl_name)
+			}
+			continue
+		}
 		for _, key := range impl.HashKeys() {
 			if conflict, conflicted := conflicts[key]; conflicted == true {
 				return &errtype.InvalidInput{
-					Message: fmt.Sprintf("Implement '%s' conflicts with '%s'", impl_name, conflict),
-					Origin:  nil,
+					Message: fmt.Sprintf(
+						"Implement %s conflicts with %s",
+						describe(second, "implement", impl_name),
+						describe(first, "implement", conflict[0]),
+					),
+					Origin: nil,
 				}
 			} else {
-				conflicts[key] = impl_name
+				conflicts[key] = append(conflicts[key], impl_name)
 			}
 		}
 		first.Implements[impl_name] = impl
+		first.AddSource("implement", impl_name, second.SourceOf("implement", impl_name))
+	}
+	for var_name, value := range second.Vars {
+		name_err := ValidateVarName(var_name)
+		if name_err != nil {
+			return &errtype.InvalidInput{
+				Message: fmt.Sprintf("Variable %s is invalid: %s", describe(second, "variable", var_name), name_err),
+				Origin:  nil,
+			}
+		}
+		if existing, found := first.Vars[var_name]; found && existing != value {
+			return nameCollision(first, second, "variable", var_name)
+		}
+		first.Vars[var_name] = value
+		first.AddSource("variable", var_name, second.SourceOf("variable", var_name))
 	}
 	return nil
 }
@@ -174,10 +339,13 @@ func SelectObservationResult(obsv_name string, obsv_results map[string]operation
 func SelectImplementActionByName(impl_name string, impls map[string]operation.Implement) *operation.Action {
 	if selected_impl, found := impls[impl_name]; found {
 		return &operation.Action{
-			Path:   selected_impl.Path,
-			Script: selected_impl.Script,
-			Exe:    selected_impl.Exe,
-			Args:   selected_impl.Reacts.Args,
+			Path:        selected_impl.Path,
+			Script:      selected_impl.Script,
+			Exe:         selected_impl.Exe,
+			Args:        selected_impl.Reacts.Args,
+			Timeout:     selected_impl.Timeout,
+			Become:      selected_impl.Become,
+			Become_User: selected_impl.Become_User,
 		}
 	}
 	return nil
@@ -187,14 +355,18 @@ func SelectImplementActionForCorrection(obsv operation.Observation, obsv_result
 	for impl_name, impl := range impls {
 		if impl.Reacts.Corrects.Entity == obsv.Entity &&
 			impl.Reacts.Corrects.Query == obsv.Query &&
-			impl.Reacts.Corrects.Results_In == obsv.Expect {
+			obsv.Expect.IsSet() &&
+			obsv.Expect.Matches(impl.Reacts.Corrects.Results_In, nil) {
 			for _, state := range impl.Reacts.Corrects.Starts_From {
 				if state == obsv_result.Result {
 					return impl_name, &operation.Action{
-						Path:   impl.Path,
-						Script: impl.Script,
-						Exe:    impl.Exe,
-						Args:   impl.Reacts.Args,
+						Path:        impl.Path,
+						Script:      impl.Script,
+						Exe:         impl.Exe,
+						Args:        impl.Reacts.Args,
+						Timeout:     impl.Timeout,
+						Become:      impl.Become,
+						Become_User: impl.Become_User,
 					}
 				}
 			}
@@ -202,3 +374,125 @@ func SelectImplementActionForCorrection(obsv operation.Observation, obsv_result
 	}
 	return "", nil
 }
+
+// Builds the list of reactions that each reaction depends on, from
+// both its own requires field and the before field of every other
+// reaction. Each list is sorted and has no duplicates.
+func ReactionDependencies(rctns map[string]operation.Reaction) (map[string][]string, error) {
+	dep_sets := make(map[string]map[string]bool)
+	for rctn_name := range rctns {
+		dep_sets[rctn_name] = make(map[string]bool)
+	}
+	for rctn_name, rctn := range rctns {
+		for _, rqrd := range rctn.Requires {
+			if _, found := rctns[rqrd]; !found {
+				return nil, &errtype.InvalidInput{
+					Message: fmt.Sprintf("Reaction '%s' requires '%s', which does not match any existing reaction names", rctn_name, rqrd),
+					Origin:  nil,
+				}
+			}
+			if rqrd == rctn_name {
+				return nil, &errtype.InvalidInput{
+					Message: fmt.Sprintf("Reaction '%s' cannot require itself", rctn_name),
+					Origin:  nil,
+				}
+			}
+			dep_sets[rctn_name][rqrd] = true
+		}
+		for _, bfr := range rctn.Before {
+			if _, found := rctns[bfr]; !found {
+				return nil, &errtype.InvalidInput{
+					Message: fmt.Sprintf("Reaction '%s' must run before '%s', which does not match any existing reaction names", rctn_name, bfr),
+					Origin:  nil,
+				}
+			}
+			if bfr == rctn_name {
+				return nil, &errtype.InvalidInput{
+					Message: fmt.Sprintf("Reaction '%s' cannot run before itself", rctn_name),
+					Origin:  nil,
+				}
+			}
+			dep_sets[bfr][rctn_name] = true
+		}
+	}
+	deps := make(map[string][]string)
+	for rctn_name, dep_set := range dep_sets {
+		deps[rctn_name] = []string{}
+		for dep := range dep_set {
+			deps[rctn_name] = append(deps[rctn_name], dep)
+		}
+		sort.Strings(deps[rctn_name])
+	}
+	return deps, nil
+}
+
+// Returns reaction names in an order where every reaction comes after
+// all of its dependencies. Reactions that don't depend on each other
+// are sorted by name so the order is always the same.
+//
+// Returns an error if the dependencies contain a cycle
+func OrderReactions(rctns map[string]operation.Reaction) ([]string, error) {
+	deps, err := ReactionDependencies(rctns)
+	if err != nil {
+		return nil, err
+	}
+	remaining := make(map[string]int)
+	dependents := make(map[string][]string)
+	for rctn_name, rctn_deps := range deps {
+		remaining[rctn_name] = len(rctn_deps)
+		for _, dep := range rctn_deps {
+			dependents[dep] = append(dependents[dep], rctn_name)
+		}
+	}
+	ready := []string{}
+	for rctn_name, count := range remaining {
+		if count == 0 {
+			ready = append(ready, rctn_name)
+		}
+	}
+	order := []string{}
+	for len(ready) > 0 {
+		sort.Strings(ready)
+		next := ready[0]
+		ready = ready[1:]
+		order = append(order, next)
+		delete(remaining, next)
+		for _, dependent := range dependents[next] {
+			remaining[dependent]--
+			if remaining[dependent] == 0 {
+				ready = append(ready, dependent)
+			}
+		}
+	}
+	if len(remaining) > 0 {
+		// Anything left over is either part of a cycle or depends on
+		// one. Trim off reactions that nothing left over depends on
+		// until only the cycle itself remains
+		for trimmed := true; trimmed; {
+			trimmed = false
+			for rctn_name := range remaining {
+				has_dependent := false
+				for _, dependent := range dependents[rctn_name] {
+					if _, left := remaining[dependent]; left {
+						has_dependent = true
+						break
+					}
+				}
+				if !has_dependent {
+					delete(remaining, rctn_name)
+					trimmed = true
+				}
+			}
+		}
+		cycle := []string{}
+		for rctn_name := range remaining {
+			cycle = append(cycle, rctn_name)
+		}
+		sort.Strings(cycle)
+		return nil, &errtype.InvalidInput{
+			Message: fmt.Sprintf("Reactions have a dependency cycle, check requires/before on: '%s'", strings.Join(cycle, "', '")),
+			Origin:  nil,
+		}
+	}
+	return order, nil
+}
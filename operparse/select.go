@@ -0,0 +1,100 @@
+package operparse
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+type selectStep struct {
+	key      string
+	index    int
+	is_index bool
+}
+
+// Select paths pick a value out of JSON output. Keys are separated by
+// dots and list items are picked with [N], for example:
+//
+//	instances[0].name
+//
+// An empty path selects the whole document
+func parseSelectPath(path string) ([]selectStep, error) {
+	steps := []selectStep{}
+	rest := strings.TrimPrefix(path, ".")
+	for len(rest) > 0 {
+		switch {
+		case strings.HasPrefix(rest, "["):
+			end := strings.Index(rest, "]")
+			if end < 0 {
+				return nil, fmt.Errorf("unclosed '[' in select path '%s'", path)
+			}
+			index, err := strconv.Atoi(rest[1:end])
+			if err != nil || index < 0 {
+				return nil, fmt.Errorf("invalid list index '%s' in select path '%s'", rest[1:end], path)
+			}
+			steps = append(steps, selectStep{index: index, is_index: true})
+			rest = rest[end+1:]
+		case strings.HasPrefix(rest, "."):
+			rest = rest[1:]
+			if len(rest) == 0 || strings.HasPrefix(rest, ".") || strings.HasPrefix(rest, "[") {
+				return nil, fmt.Errorf("empty key in select path '%s'", path)
+			}
+		default:
+			end := strings.IndexAny(rest, ".[")
+			if end < 0 {
+				end = len(rest)
+			}
+			steps = append(steps, selectStep{key: rest[:end]})
+			rest = rest[end:]
+		}
+	}
+	return steps, nil
+}
+
+func ValidateSelectPath(path string) error {
+	_, err := parseSelectPath(path)
+	return err
+}
+
+// SelectJSON parses raw JSON output and returns the value at path
+func SelectJSON(raw_output string, path string) (interface{}, error) {
+	steps, err := parseSelectPath(path)
+	if err != nil {
+		return nil, err
+	}
+	var value interface{}
+	err = json.Unmarshal([]byte(raw_output), &value)
+	if err != nil {
+		return nil, fmt.Errorf("output is not valid JSON: %s", err)
+	}
+	walked := ""
+	for _, step := range steps {
+		if step.is_index {
+			walked += fmt.Sprintf("[%d]", step.index)
+			list, ok := value.([]interface{})
+			if !ok {
+				return nil, fmt.Errorf("cannot select '%s', value is not a list", walked)
+			}
+			if step.index >= len(list) {
+				return nil, fmt.Errorf("cannot select '%s', list only has %d items", walked, len(list))
+			}
+			value = list[step.index]
+		} else {
+			if len(walked) > 0 {
+				walked += "."
+			}
+			walked += step.key
+			object, ok := value.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("cannot select '%s', value is not an object", walked)
+			}
+			field, found := object[step.key]
+			if !found {
+				return nil, fmt.Errorf("cannot select '%s', key not found", walked)
+			}
+			value = field
+		}
+	}
+	return value, nil
+}
@@ -0,0 +1,250 @@
+package operparse
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/mcdonaldseanp/clibuild/errtype"
+	"github.com/mcdonaldseanp/lookout/operation"
+)
+
+// Environment variables with this prefix set lookout variables,
+// e.g. LOOKOUT_VAR_port=8080 sets ${{ port }}
+const VAR_ENV_PREFIX string = "LOOKOUT_VAR_"
+
+// Included in errors about variables so that it's clear
+// where a value could have come from
+const VAR_PRECEDENCE string = "variables are taken from --var first, then " + VAR_ENV_PREFIX +
+	"<name> in the environment, then vars in the inventory, then vars in the spec"
+
+// Variables are used as ${{ name }}. $${{ name }} is left in place
+// as a literal ${{ name }}
+var var_reference = regexp.MustCompile(`\$?\$\{\{\s*([^{}]*?)\s*\}\}`)
+var var_name = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+func ValidateVarName(name string) error {
+	if !var_name.MatchString(name) {
+		return fmt.Errorf("variable names can only use letters, numbers and _, and cannot start with a number, given '%s'", name)
+	}
+	return nil
+}
+
+// VarList is a flag.Value for --var key=value that can be passed
+// more than once
+type VarList []string
+
+func (vl *VarList) String() string {
+	return strings.Join(*vl, ",")
+}
+
+func (vl *VarList) Set(value string) error {
+	name, _, found := strings.Cut(value, "=")
+	if !found {
+		return fmt.Errorf("must be name=value, given '%s'", value)
+	}
+	if err := ValidateVarName(name); err != nil {
+		return err
+	}
+	*vl = append(*vl, value)
+	return nil
+}
+
+// Map returns the variables, later values for the same name win
+func (vl VarList) Map() map[string]string {
+	vars := make(map[string]string)
+	for _, raw := range vl {
+		name, value, _ := strings.Cut(raw, "=")
+		vars[name] = value
+	}
+	return vars
+}
+
+// EnvVars finds the lookout variables in a list of environment
+// variables, as returned by os.Environ
+func EnvVars(environ []string) map[string]string {
+	vars := make(map[string]string)
+	for _, raw := range environ {
+		name, value, _ := strings.Cut(raw, "=")
+		if var_name := strings.TrimPrefix(name, VAR_ENV_PREFIX); var_name != name && ValidateVarName(var_name) == nil {
+			vars[var_name] = value
+		}
+	}
+	return vars
+}
+
+// ReadVarsEnv reads variables from an environment variable holding
+// a JSON object of names to values. Remote commands send variables
+// this way so that they never show up in the process list on the
+// target. The environment variable is cleared afterwards so that
+// implements never see it
+func ReadVarsEnv(env_name string) (map[string]string, error) {
+	if env_name == "" {
+		return nil, nil
+	}
+	raw_vars, found := os.LookupEnv(env_name)
+	if !found {
+		return nil, fmt.Errorf("environment variable %s is not set", env_name)
+	}
+	os.Unsetenv(env_name)
+	var vars map[string]string
+	err := json.Unmarshal([]byte(raw_vars), &vars)
+	if err != nil {
+		return nil, fmt.Errorf("environment variable %s must hold a JSON object of variable names to values: %s", env_name, err)
+	}
+	for _, name := range sortedNames(vars) {
+		if err := ValidateVarName(name); err != nil {
+			return nil, err
+		}
+	}
+	return vars, nil
+}
+
+// MergeVars merges sets of variables, lowest precedence first
+func MergeVars(layers ...map[string]string) map[string]string {
+	vars := make(map[string]string)
+	for _, layer := range layers {
+		for name, value := range layer {
+			vars[name] = value
+		}
+	}
+	return vars
+}
+
+// SubstituteVars replaces every variable in text, and returns the
+// names of any variables that aren't defined
+func SubstituteVars(text string, vars map[string]string) (string, []string) {
+	missing := []string{}
+	substituted := var_reference.ReplaceAllStringFunc(text, func(reference string) string {
+		if strings.HasPrefix(reference, "$$") {
+			return reference[1:]
+		}
+		name := var_reference.FindStringSubmatch(reference)[1]
+		value, found := vars[name]
+		if !found {
+			missing = append(missing, name)
+			return reference
+		}
+		return value
+	})
+	return substituted, missing
+}
+
+// Keeps track of every problem found while substituting so
+// that they can all be reported at once
+type varSubstitution struct {
+	vars        map[string]string
+	diagnostics []Diagnostic
+}
+
+func (vs *varSubstitution) text(kind string, name string, field string, text string) string {
+	substituted, missing := SubstituteVars(text, vs.vars)
+	for _, missing_name := range missing {
+		vs.diagnostics = append(vs.diagnostics, Diagnostic{
+			Level:   DIAGNOSTIC_ERROR,
+			Kind:    kind,
+			Name:    name,
+			Message: fmt.Sprintf("%s uses undefined variable '%s', %s", field, missing_name, VAR_PRECEDENCE),
+		})
+	}
+	return substituted
+}
+
+func (vs *varSubstitution) list(kind string, name string, field string, texts []string) []string {
+	if texts == nil {
+		return nil
+	}
+	substituted := make([]string, len(texts))
+	for index, text := range texts {
+		substituted[index] = vs.text(kind, name, field, text)
+	}
+	return substituted
+}
+
+func (vs *varSubstitution) expectation(name string, expt *operation.Expectation) *operation.Expectation {
+	if expt == nil {
+		return nil
+	}
+	substituted := *expt
+	substituted.Exact = vs.text("observation", name, "expect", expt.Exact)
+	substituted.Trimmed = vs.text("observation", name, "expect", expt.Trimmed)
+	substituted.Regex = vs.text("observation", name, "expect", expt.Regex)
+	substituted.One_Of = vs.list("observation", name, "expect", expt.One_Of)
+	// The values might make a regex invalid
+	if err := substituted.Validate(); err != nil {
+		vs.diagnostics = append(vs.diagnostics, Diagnostic{
+			Level:   DIAGNOSTIC_ERROR,
+			Kind:    "observation",
+			Name:    name,
+			Message: fmt.Sprintf("invalid after substituting variables: %s", err),
+		})
+	}
+	return &substituted
+}
+
+func substituteAll(data *operation.Operations, vars map[string]string) (*operation.Operations, []Diagnostic) {
+	vs := &varSubstitution{vars: vars, diagnostics: []Diagnostic{}}
+	substituted := *data
+	substituted.Observations = make(map[string]operation.Observation)
+	for _, obsv_name := range sortedNames(data.Observations) {
+		obsv := data.Observations[obsv_name]
+		obsv.Instance = vs.text("observation", obsv_name, "instance", obsv.Instance)
+		obsv.Expect = vs.expectation(obsv_name, obsv.Expect)
+		substituted.Observations[obsv_name] = obsv
+	}
+	substituted.Implements = make(map[string]operation.Implement)
+	for _, impl_name := range sortedNames(data.Implements) {
+		impl := data.Implements[impl_name]
+		impl.Path = vs.text("implement", impl_name, "path", impl.Path)
+		impl.Script = vs.text("implement", impl_name, "script", impl.Script)
+		impl.Observes.Args = vs.list("implement", impl_name, "observes args", impl.Observes.Args)
+		impl.Reacts.Args = vs.list("implement", impl_name, "reacts args", impl.Reacts.Args)
+		impl.Reacts.Corrects.Starts_From = vs.list("implement", impl_name, "starts_from", impl.Reacts.Corrects.Starts_From)
+		impl.Reacts.Corrects.Results_In = vs.text("implement", impl_name, "results_in", impl.Reacts.Corrects.Results_In)
+		substituted.Implements[impl_name] = impl
+	}
+	substituted.Actions = make(map[string]operation.Action)
+	for _, actn_name := range sortedNames(data.Actions) {
+		actn := data.Actions[actn_name]
+		actn.Path = vs.text("action", actn_name, "path", actn.Path)
+		actn.Script = vs.text("action", actn_name, "script", actn.Script)
+		actn.Args = vs.list("action", actn_name, "args", actn.Args)
+		substituted.Actions[actn_name] = actn
+	}
+	return &substituted, vs.diagnostics
+}
+
+// ApplyVars returns a copy of data with every ${{ name }} in args,
+// expect, instance, script and path replaced. vars should already
+// be merged with MergeVars in precedence order
+func ApplyVars(data *operation.Operations, vars map[string]string) (*operation.Operations, error) {
+	substituted, diagnostics := substituteAll(data, vars)
+	if len(diagnostics) > 0 {
+		messages := make([]string, len(diagnostics))
+		for index, diagnostic := range diagnostics {
+			messages[index] = fmt.Sprintf("%s %s %s",
+				strings.ToUpper(diagnostic.Kind[:1])+diagnostic.Kind[1:],
+				describe(data, diagnostic.Kind, diagnostic.Name),
+				diagnostic.Message,
+			)
+		}
+		return nil, &errtype.InvalidInput{
+			Message: strings.Join(messages, "\n"),
+			Origin:  nil,
+		}
+	}
+	return substituted, nil
+}
+
+// CheckVars reports every undefined variable in a spec
+func CheckVars(data *operation.Operations, vars map[string]string) []Diagnostic {
+	_, diagnostics := substituteAll(data, vars)
+	return diagnostics
+}
+
+// SortedVarNames lists variable names in a stable order
+func SortedVarNames(vars map[string]string) []string {
+	return sortedNames(vars)
+}
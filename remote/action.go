@@ -1,16 +1,24 @@
 package remote
 
 import (
+	"encoding/json"
 	"fmt"
 
 	"github.com/mcdonaldseanp/clibuild/errtype"
 	"github.com/mcdonaldseanp/clibuild/validator"
-	"github.com/mcdonaldseanp/lookout/localdata"
+	"github.com/mcdonaldseanp/lookout/inventory"
+	"github.com/mcdonaldseanp/lookout/local"
+	"github.com/mcdonaldseanp/lookout/operation"
 	"github.com/mcdonaldseanp/lookout/remoteexec"
+	"github.com/mcdonaldseanp/lookout/render"
 )
 
-func Run(raw_data []byte, actn_name string, username string, target string, port string) (string, error) {
-	err := validator.ValidateParams(fmt.Sprintf(
+func Run(raw_data []byte, actn_name string, conn remoteexec.Connection, vars map[string]string, opts Options) (string, error) {
+	conn, err := remoteexec.ResolveConnection(conn)
+	if err != nil {
+		return "", err
+	}
+	err = validator.ValidateParams(fmt.Sprintf(
 		`[
 			{"name":"action name","value":"%s","validate":["NotEmpty"]},
 			{"name":"username","value":"%s","validate":["NotEmpty"]},
@@ -18,16 +26,22 @@ func Run(raw_data []byte, actn_name string, username string, target string, port
 			{"name":"port","value":"%s","validate":["NotEmpty","IsNumber"]}
 		 ]`,
 		actn_name,
-		username,
-		target,
-		port,
+		conn.Username,
+		conn.Target,
+		conn.Port,
 	))
 	if err != nil {
 		return "", err
 	}
-	command := fmt.Sprintf("$HOME/.lookout/bin/lookout run local \"%s\" --stdin", actn_name)
-	sout, serr, ec, err := remoteexec.RunSSHCommand(command, string(raw_data), username, target, port)
+	command, stdin := clientCommand("$HOME/.lookout/bin/lookout run local "+shellQuote(actn_name)+" --stdin", raw_data, vars, opts)
+	sout, serr, ec, err := remoteexec.RunSSHCommand(command, stdin, conn)
 	if err != nil {
+		// Anything other than a shell error means the command never
+		// ran, like a host key or auth failure, and the error is more
+		// useful than a generic shell error
+		if _, ran := err.(*errtype.RemoteShellError); !ran {
+			return sout, err
+		}
 		origin := err
 		if errtype_origin, ok := origin.(*errtype.RemoteShellError); ok {
 			origin = errtype_origin.Origin
@@ -43,15 +57,42 @@ func Run(raw_data []byte, actn_name string, username string, target string, port
 	return sout, nil
 }
 
-func CLIRun(maybe_file string, actn_name string, username string, target string, port string) error {
-	raw_data, err := localdata.ReadFileOrStdin(maybe_file)
+// CLIRun prints the results from a single target with the version
+// of its lookout client added. Anything that could select more
+// than one target (see inventory.IsSelector) combines them with
+// RunFleet, even when it only matched one, so the shape of the
+// output only depends on what was asked for
+func CLIRun(maybe_files []string, actn_name string, raw_targets string, conn remoteexec.Connection, opts Options) error {
+	targets, err := SelectTargets(raw_targets, conn, opts)
 	if err != nil {
 		return err
 	}
-	sout, err := Run(raw_data, actn_name, username, target, port)
+	raw_data, data, err := readSpec(maybe_files)
+	if err != nil {
+		return err
+	}
+	if inventory.IsSelector(raw_targets) {
+		results := RunFleet(raw_data, data, actn_name, targets, opts)
+		return local.WorstFailure(
+			printFleet(results, results.Total_Targets, results.Failed_Targets, opts),
+			actionsFailure(results, opts.Fail_On),
+		)
+	}
+	output := runOnTarget(data, targets[0], opts, func(vars map[string]string) (string, error) {
+		return Run(raw_data, actn_name, targets[0].Connection, vars, opts)
+	})
+	if output.err != nil {
+		return output.err
+	}
+	var results operation.ActionResults
+	err = json.Unmarshal([]byte(output.output), &results)
+	if err != nil {
+		return invalidJSON(output.output, err)
+	}
+	results.Remote_Version = output.remote_version
+	err = render.Print(results, opts.Output)
 	if err != nil {
 		return err
 	}
-	fmt.Printf("%s", sout)
-	return nil
+	return local.ActionsFailure(results, opts.Fail_On)
 }
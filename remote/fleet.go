@@ -0,0 +1,399 @@
+package remote
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/mcdonaldseanp/clibuild/errtype"
+	"github.com/mcdonaldseanp/lookout/inventory"
+	"github.com/mcdonaldseanp/lookout/local"
+	"github.com/mcdonaldseanp/lookout/operation"
+	"github.com/mcdonaldseanp/lookout/remoteexec"
+	"github.com/mcdonaldseanp/lookout/render"
+)
+
+// The result from one target in a fleet run. Error is set instead
+// of Results when the target couldn't be reached or the lookout
+// client on it failed
+type TargetResult[T any] struct {
+	Succeeded      bool   `yaml:"succeeded" json:"succeeded"`
+	Error          string `yaml:"error,omitempty" json:"error,omitempty"`
+	Remote_Version string `yaml:"remote_version,omitempty" json:"remote_version,omitempty"`
+	Results        *T     `yaml:"results,omitempty" json:"results,omitempty"`
+}
+
+type FleetObservationResults struct {
+	Targets                 map[string]TargetResult[operation.ObservationResults] `yaml:"targets" json:"targets"`
+	Total_Targets           int                                                   `yaml:"total_targets" json:"total_targets"`
+	Failed_Targets          int                                                   `yaml:"failed_targets" json:"failed_targets"`
+	Total_Observations      int                                                   `yaml:"total_observations" json:"total_observations"`
+	Failed_Observations     int                                                   `yaml:"failed_observations" json:"failed_observations"`
+	Unexpected_Observations int                                                   `yaml:"unexpected_observations" json:"unexpected_observations"`
+}
+
+type FleetReactionResults struct {
+	Targets                 map[string]TargetResult[operation.ReactionResults] `yaml:"targets" json:"targets"`
+	Total_Targets           int                                                `yaml:"total_targets" json:"total_targets"`
+	Failed_Targets          int                                                `yaml:"failed_targets" json:"failed_targets"`
+	Total_Observations      int                                                `yaml:"total_observations" json:"total_observations"`
+	Failed_Observations     int                                                `yaml:"failed_observations" json:"failed_observations"`
+	Unexpected_Observations int                                                `yaml:"unexpected_observations" json:"unexpected_observations"`
+	Total_Reactions         int                                                `yaml:"total_reactions" json:"total_reactions"`
+	Failed_Reactions        int                                                `yaml:"failed_reactions" json:"failed_reactions"`
+	Skipped_Reactions       int                                                `yaml:"skipped_reactions" json:"skipped_reactions"`
+}
+
+type FleetActionResults struct {
+	Targets        map[string]TargetResult[operation.ActionResults] `yaml:"targets" json:"targets"`
+	Total_Targets  int                                              `yaml:"total_targets" json:"total_targets"`
+	Failed_Targets int                                              `yaml:"failed_targets" json:"failed_targets"`
+	Total_Actions  int                                              `yaml:"total_actions" json:"total_actions"`
+	Failed_Actions int                                              `yaml:"failed_actions" json:"failed_actions"`
+}
+
+// One target to connect to, with its connection settings
+// and variables from the inventory already applied
+type Target struct {
+	Name       string
+	Connection remoteexec.Connection
+	Vars       map[string]string
+}
+
+// SplitTargets splits a comma separated list of targets,
+// dropping any target that is listed more than once
+func SplitTargets(raw_targets string) ([]string, error) {
+	targets := []string{}
+	seen := make(map[string]bool)
+	for _, target := range strings.Split(raw_targets, ",") {
+		target = strings.TrimSpace(target)
+		if target == "" {
+			return nil, &errtype.InvalidInput{
+				Message: fmt.Sprintf("target list '%s' has an empty target", raw_targets),
+				Origin:  nil,
+			}
+		}
+		if !seen[target] {
+			seen[target] = true
+			targets = append(targets, target)
+		}
+	}
+	return targets, nil
+}
+
+// SelectTargets turns the targets given on the CLI into connections.
+// Without an inventory targets are plain host names. With one, they
+// are selectors (see inventory.Select) and the inventory settings
+// fill in whatever the CLI flags in conn didn't set
+func SelectTargets(raw_targets string, conn remoteexec.Connection, opts Options) ([]Target, error) {
+	targets := []Target{}
+	if opts.Inventory == "" {
+		names, err := SplitTargets(raw_targets)
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range names {
+			if strings.HasPrefix(name, "group:") || strings.ContainsAny(name, "*?[") {
+				return nil, &errtype.InvalidInput{
+					Message: fmt.Sprintf("target '%s' is a selector, which needs --inventory", name),
+					Origin:  nil,
+				}
+			}
+			target_conn := conn
+			target_conn.Target = name
+			targets = append(targets, Target{Name: name, Connection: target_conn})
+		}
+		return targets, nil
+	}
+	inv, err := inventory.Load(opts.Inventory)
+	if err != nil {
+		return nil, err
+	}
+	hosts, err := inv.Select(raw_targets)
+	if err != nil {
+		return nil, err
+	}
+	for _, host := range hosts {
+		target_conn := conn
+		target_conn.Target = host.Name
+		if target_conn.Host_Name == "" {
+			target_conn.Host_Name = host.Settings.Host_Name
+		}
+		if target_conn.Username == "" {
+			target_conn.Username = host.Settings.User
+		}
+		if target_conn.Port == "" {
+			target_conn.Port = host.Settings.Port
+		}
+		if target_conn.Identity_File == "" {
+			target_conn.Identity_File = host.Settings.Identity_File
+		}
+		if target_conn.Proxy_Jump == "" {
+			target_conn.Proxy_Jump = host.Settings.Proxy_Jump
+		}
+		targets = append(targets, Target{Name: host.Name, Connection: target_conn, Vars: host.Settings.Vars})
+	}
+	return targets, nil
+}
+
+type targetOutput struct {
+	output         string
+	remote_version string
+	err            error
+}
+
+// fanOut runs fn once for every target, with at most
+// opts.Concurrency targets running at the same time
+func fanOut(targets []Target, opts Options, fn func(target Target) targetOutput) map[string]targetOutput {
+	outputs := make(map[string]targetOutput)
+	concurrency := opts.Concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	// Hand out targets in sorted order so that a run with
+	// concurrency 1 always connects in the same order
+	sorted_targets := append([]Target{}, targets...)
+	sort.Slice(sorted_targets, func(i, j int) bool {
+		return sorted_targets[i].Name < sorted_targets[j].Name
+	})
+
+	type named_output struct {
+		target string
+		output targetOutput
+	}
+	jobs := make(chan Target)
+	finished := make(chan named_output)
+	var workers sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for target := range jobs {
+				finished <- named_output{
+					target: target.Name,
+					output: fn(target),
+				}
+			}
+		}()
+	}
+	go func() {
+		for _, target := range sorted_targets {
+			jobs <- target
+		}
+		close(jobs)
+		workers.Wait()
+		close(finished)
+	}()
+
+	for this := range finished {
+		outputs[this.target] = this.output
+	}
+	return outputs
+}
+
+// fleetCases lists the cases from every target, with a failed
+// case for each target that couldn't run at all
+func fleetCases[T any](targets map[string]TargetResult[T]) []render.Case {
+	cases := []render.Case{}
+	target_names := make([]string, 0, len(targets))
+	for target := range targets {
+		target_names = append(target_names, target)
+	}
+	sort.Strings(target_names)
+	for _, target := range target_names {
+		result := targets[target]
+		if !result.Succeeded {
+			cases = append(cases, render.Case{
+				Target:  target,
+				Kind:    "target",
+				Name:    target,
+				Status:  render.CASE_FAILED,
+				Summary: result.Error,
+				Details: result.Error,
+			})
+			continue
+		}
+		target_cases, err := render.Cases(result.Results)
+		if err != nil {
+			continue
+		}
+		for _, this := range target_cases {
+			this.Target = target
+			cases = append(cases, this)
+		}
+	}
+	return cases
+}
+
+func (results FleetObservationResults) Cases() []render.Case {
+	return fleetCases(results.Targets)
+}
+
+func (results FleetReactionResults) Cases() []render.Case {
+	return fleetCases(results.Targets)
+}
+
+func (results FleetActionResults) Cases() []render.Case {
+	return fleetCases(results.Targets)
+}
+
+// runOnTarget checks variables and the lookout client version on a
+// target before running fn there
+func runOnTarget(data *operation.Operations, target Target, opts Options, fn func(vars map[string]string) (string, error)) targetOutput {
+	vars, err := targetVars(data, target, opts)
+	if err != nil {
+		return targetOutput{err: err}
+	}
+	remote_version, err := checkVersion(target.Connection, opts)
+	if err != nil {
+		return targetOutput{err: err}
+	}
+	output, err := fn(vars)
+	return targetOutput{output: output, remote_version: remote_version, err: err}
+}
+
+// targetResult parses the JSON the lookout client on a target printed
+func targetResult[T any](output targetOutput) TargetResult[T] {
+	if output.err != nil {
+		return TargetResult[T]{Succeeded: false, Error: errorMessage(output.err), Remote_Version: output.remote_version}
+	}
+	var results T
+	err := json.Unmarshal([]byte(output.output), &results)
+	if err != nil {
+		return TargetResult[T]{
+			Succeeded:      false,
+			Error:          invalidJSON(output.output, err).Error(),
+			Remote_Version: output.remote_version,
+		}
+	}
+	return TargetResult[T]{Succeeded: true, Results: &results, Remote_Version: output.remote_version}
+}
+
+func invalidJSON(output string, err error) error {
+	return fmt.Errorf("lookout client on remote target returned invalid JSON: %s\n\nStdout:\n%s\n", err, output)
+}
+
+// InvalidInput errors print with an "invalid input" header and a
+// trace, which doesn't read well inside a result
+func errorMessage(err error) string {
+	if invalid, ok := err.(*errtype.InvalidInput); ok {
+		return invalid.Message
+	}
+	return err.Error()
+}
+
+func ObserveFleet(raw_data []byte, data *operation.Operations, impl_files []ImplementFile, targets []Target, opts Options) FleetObservationResults {
+	results := FleetObservationResults{Targets: make(map[string]TargetResult[operation.ObservationResults])}
+	outputs := fanOut(targets, opts, func(target Target) targetOutput {
+		return runOnTarget(data, target, opts, func(vars map[string]string) (string, error) {
+			return Observe(raw_data, impl_files, target.Connection, vars, opts)
+		})
+	})
+	for target, output := range outputs {
+		result := targetResult[operation.ObservationResults](output)
+		results.Targets[target] = result
+		results.Total_Targets++
+		if !result.Succeeded {
+			results.Failed_Targets++
+			continue
+		}
+		results.Total_Observations += result.Results.Total_Observations
+		results.Failed_Observations += result.Results.Failed_Observations
+		results.Unexpected_Observations += result.Results.Unexpected_Observations
+	}
+	return results
+}
+
+func ReactFleet(raw_data []byte, data *operation.Operations, impl_files []ImplementFile, targets []Target, opts Options) FleetReactionResults {
+	results := FleetReactionResults{Targets: make(map[string]TargetResult[operation.ReactionResults])}
+	outputs := fanOut(targets, opts, func(target Target) targetOutput {
+		return runOnTarget(data, target, opts, func(vars map[string]string) (string, error) {
+			return React(raw_data, impl_files, target.Connection, vars, opts)
+		})
+	})
+	for target, output := range outputs {
+		result := targetResult[operation.ReactionResults](output)
+		results.Targets[target] = result
+		results.Total_Targets++
+		if !result.Succeeded {
+			results.Failed_Targets++
+			continue
+		}
+		results.Total_Observations += result.Results.Total_Observations
+		results.Failed_Observations += result.Results.Failed_Observations
+		results.Unexpected_Observations += result.Results.Unexpected_Observations
+		results.Total_Reactions += result.Results.Total_Reactions
+		results.Failed_Reactions += result.Results.Failed_Reactions
+		results.Skipped_Reactions += result.Results.Skipped_Reactions
+	}
+	return results
+}
+
+func RunFleet(raw_data []byte, data *operation.Operations, actn_name string, targets []Target, opts Options) FleetActionResults {
+	results := FleetActionResults{Targets: make(map[string]TargetResult[operation.ActionResults])}
+	outputs := fanOut(targets, opts, func(target Target) targetOutput {
+		return runOnTarget(data, target, opts, func(vars map[string]string) (string, error) {
+			return Run(raw_data, actn_name, target.Connection, vars, opts)
+		})
+	})
+	for target, output := range outputs {
+		result := targetResult[operation.ActionResults](output)
+		results.Targets[target] = result
+		results.Total_Targets++
+		if !result.Succeeded {
+			results.Failed_Targets++
+			continue
+		}
+		for _, actn_result := range result.Results.Actions {
+			results.Total_Actions++
+			if !actn_result.Succeeded {
+				results.Failed_Actions++
+			}
+		}
+	}
+	return results
+}
+
+// printFleet prints fleet results in the --output format. Results
+// are always printed so that the targets that did succeed aren't
+// lost, but the command still fails when any target couldn't be
+// reached
+func printFleet(results interface{}, total_targets int, failed_targets int, opts Options) error {
+	err := render.Print(results, opts.Output)
+	if err != nil {
+		return err
+	}
+	if failed_targets > 0 {
+		return &local.ResultError{
+			Exit_Code: local.EXIT_EXECUTION_FAILED,
+			Message:   fmt.Sprintf("%d of %d targets failed", failed_targets, total_targets),
+		}
+	}
+	return nil
+}
+
+// reactionsFailure checks the results from every target that
+// ran against --fail-on
+func reactionsFailure(results FleetReactionResults, fail_on string) error {
+	failures := []error{}
+	for _, result := range results.Targets {
+		if result.Succeeded {
+			failures = append(failures, local.ReactionsFailure(*result.Results, fail_on))
+		}
+	}
+	return local.WorstFailure(failures...)
+}
+
+// actionsFailure checks the results from every target that ran
+// against --fail-on
+func actionsFailure(results FleetActionResults, fail_on string) error {
+	failures := []error{}
+	for _, result := range results.Targets {
+		if result.Succeeded {
+			failures = append(failures, local.ActionsFailure(*result.Results, fail_on))
+		}
+	}
+	return local.WorstFailure(failures...)
+}
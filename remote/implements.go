@@ -0,0 +1,156 @@
+package remote
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/mcdonaldseanp/clibuild/errtype"
+	"github.com/mcdonaldseanp/lookout/local"
+	"github.com/mcdonaldseanp/lookout/localdata"
+	"github.com/mcdonaldseanp/lookout/operation"
+	"github.com/mcdonaldseanp/lookout/remotedata"
+	"github.com/mcdonaldseanp/lookout/remoteexec"
+)
+
+// Downloaded implement source files are kept here on the controller,
+// named by the checksum of their url. Delete a file to download it again
+const IMPLS_CACHE_LOC string = ".lookout/cache/impls"
+
+// An implement source file the controller has downloaded,
+// ready to copy to targets
+type ImplementFile struct {
+	Source_File string
+	Source_Url  string
+	Checksum    string
+	Data        []byte
+}
+
+// cachedDownload only downloads a url the first time it is used
+func cachedDownload(url string) ([]byte, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return remotedata.Download(url)
+	}
+	cache_file := filepath.Join(home, IMPLS_CACHE_LOC, sha256Sum([]byte(url)))
+	if raw_data, err := os.ReadFile(cache_file); err == nil {
+		return raw_data, nil
+	}
+	raw_data, err := remotedata.Download(url)
+	if err != nil {
+		return nil, err
+	}
+	err = os.MkdirAll(filepath.Dir(cache_file), 0755)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create implement cache:\n%s", err)
+	}
+	err = localdata.OverwriteFile(cache_file, raw_data)
+	if err != nil {
+		return nil, err
+	}
+	return raw_data, nil
+}
+
+// ResolveImplements downloads every implement source file in the spec
+// on the controller, so that targets never need to reach source_url
+// themselves. The files are copied to each target by shipImplements
+func ResolveImplements(data *operation.Operations) ([]ImplementFile, error) {
+	impl_files := []ImplementFile{}
+	urls := make(map[string]string)
+	// Sorted so that conflicting source files are always
+	// reported the same way
+	impl_names := make([]string, 0, len(data.Implements))
+	for impl_name := range data.Implements {
+		impl_names = append(impl_names, impl_name)
+	}
+	sort.Strings(impl_names)
+	for _, impl_name := range impl_names {
+		impl := data.Implements[impl_name]
+		if len(impl.Source_Url) < 1 || len(impl.Source_File) < 1 {
+			continue
+		}
+		if impl.Source_File != filepath.Base(impl.Source_File) || impl.Source_File == ".." {
+			return nil, &errtype.InvalidInput{
+				Message: fmt.Sprintf("implement '%s' has source_file '%s', which has to be a file name without a directory", impl_name, impl.Source_File),
+				Origin:  nil,
+			}
+		}
+		if url, found := urls[impl.Source_File]; found {
+			if url != impl.Source_Url {
+				return nil, &errtype.InvalidInput{
+					Message: fmt.Sprintf("implement '%s' downloads source_file '%s' from %s, but another implement downloads it from %s", impl_name, impl.Source_File, impl.Source_Url, url),
+					Origin:  nil,
+				}
+			}
+			continue
+		}
+		urls[impl.Source_File] = impl.Source_Url
+		raw_data, err := cachedDownload(impl.Source_Url)
+		if err != nil {
+			return nil, fmt.Errorf("failed to download source_file for implement '%s':\n%s", impl_name, err)
+		}
+		impl_files = append(impl_files, ImplementFile{
+			Source_File: impl.Source_File,
+			Source_Url:  impl.Source_Url,
+			Checksum:    sha256Sum(raw_data),
+			Data:        raw_data,
+		})
+	}
+	return impl_files, nil
+}
+
+// shipImplements copies implement source files to the target,
+// skipping any the target already has with the same checksum
+func shipImplements(conn remoteexec.Connection, impl_files []ImplementFile) error {
+	if len(impl_files) < 1 {
+		return nil
+	}
+	quoted_files := make([]string, len(impl_files))
+	for index, impl_file := range impl_files {
+		quoted_files[index] = shellQuote(impl_file.Source_File)
+	}
+	// Newlines are stripped from the output, so print one checksum per
+	// file separated by spaces, with - for files the target doesn't have
+	command := fmt.Sprintf(
+		`cd $HOME/%s 2> /dev/null || exit 0
+		for impl_file in %s; do
+			if [ -f "$impl_file" ]; then
+				%s "$impl_file" | cut -d ' ' -f 1 | tr -d '\n'
+			else
+				printf -
+			fi
+			printf ' '
+		done`,
+		local.IMPLS_LOC,
+		strings.Join(quoted_files, " "),
+		SHA256_COMMAND,
+	)
+	sout, serr, ec, err := remoteexec.RunSSHCommand(command, "", conn)
+	if err != nil {
+		if _, ran := err.(*errtype.RemoteShellError); !ran {
+			return err
+		}
+		return fmt.Errorf("failed to list implements on target %s, exit code %d\n\nStdout:\n%s\nStderr:\n%s\n", conn.Target, ec, sout, serr)
+	}
+	remote_checksums := make(map[string]string)
+	for index, checksum := range strings.Fields(sout) {
+		if index < len(impl_files) {
+			remote_checksums[impl_files[index].Source_File] = checksum
+		}
+	}
+	for _, impl_file := range impl_files {
+		if remote_checksums[impl_file.Source_File] == impl_file.Checksum {
+			continue
+		}
+		sout, serr, ec, err := streamFile(conn, local.IMPLS_LOC+"/"+impl_file.Source_File, impl_file.Data, impl_file.Checksum)
+		if err != nil {
+			if _, ran := err.(*errtype.RemoteShellError); !ran {
+				return err
+			}
+			return fmt.Errorf("failed to copy implement source file %s to target %s, exit code %d\n\nStdout:\n%s\nStderr:\n%s\n", impl_file.Source_File, conn.Target, ec, sout, serr)
+		}
+	}
+	return nil
+}
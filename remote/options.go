@@ -0,0 +1,84 @@
+package remote
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/mcdonaldseanp/clibuild/errtype"
+	"github.com/mcdonaldseanp/lookout/local"
+	"github.com/mcdonaldseanp/lookout/render"
+)
+
+// Options that come from the CLI and apply to every
+// target in a run
+type Options struct {
+	// Number of targets to connect to at the same time
+	Concurrency int
+	// Passed on to the lookout client on each target, see
+	// local.Options
+	Plan bool
+	// Path to the inventory file targets are selected from,
+	// see SelectTargets
+	Inventory string
+	// Variables from --var, which win over inventory vars
+	// and are passed on to the lookout client on each target
+	Vars map[string]string
+	// What to do when the lookout client on a target is a
+	// different version, one of VERSION_CHECKS
+	Version_Check string
+	// Upgrade the lookout client by uploading a binary over
+	// ssh instead of downloading a release on the target, see
+	// Upload. An empty Upgrade_Binary uploads the running one
+	Upgrade_Upload bool
+	Upgrade_Binary string
+	// How results are printed, one of render.OUTPUTS
+	Output string
+	// What makes observe, react and run exit non-zero, one of
+	// local.FAIL_ONS. Applies to the combined results, the
+	// lookout client on each target never fails on results
+	Fail_On string
+	// Don't record the results from each target. The lookout
+	// client on each target never records them, only the
+	// controller does
+	No_History bool
+	// How many days of history to keep, zero keeps everything
+	History_Days int
+	// Passed on to the lookout client on each target, see
+	// local.BecomeOptions
+	local.BecomeOptions
+}
+
+func NewOptions(concurrency int, version_check string, output string, fail_on string) (Options, error) {
+	if concurrency < 1 {
+		return Options{}, &errtype.InvalidInput{
+			Message: fmt.Sprintf("--concurrency must be at least 1, given %d", concurrency),
+			Origin:  nil,
+		}
+	}
+	valid_check := false
+	for _, mode := range VERSION_CHECKS {
+		if version_check == mode {
+			valid_check = true
+		}
+	}
+	if !valid_check {
+		return Options{}, &errtype.InvalidInput{
+			Message: fmt.Sprintf("--version-check must be one of %s, given '%s'", strings.Join(VERSION_CHECKS, ", "), version_check),
+			Origin:  nil,
+		}
+	}
+	err := render.ValidateFormat(output)
+	if err != nil {
+		return Options{}, err
+	}
+	err = local.ValidateFailOn(fail_on)
+	if err != nil {
+		return Options{}, err
+	}
+	return Options{
+		Concurrency:   concurrency,
+		Version_Check: version_check,
+		Output:        output,
+		Fail_On:       fail_on,
+	}, nil
+}
@@ -1,30 +1,50 @@
 package remote
 
 import (
+	"encoding/json"
 	"fmt"
 
 	"github.com/mcdonaldseanp/clibuild/errtype"
 	"github.com/mcdonaldseanp/clibuild/validator"
-	"github.com/mcdonaldseanp/lookout/localdata"
+	"github.com/mcdonaldseanp/lookout/history"
+	"github.com/mcdonaldseanp/lookout/inventory"
+	"github.com/mcdonaldseanp/lookout/local"
+	"github.com/mcdonaldseanp/lookout/operation"
 	"github.com/mcdonaldseanp/lookout/remoteexec"
+	"github.com/mcdonaldseanp/lookout/render"
 )
 
-func React(raw_data []byte, username string, target string, port string) (string, error) {
-	err := validator.ValidateParams(fmt.Sprintf(
+func React(raw_data []byte, impl_files []ImplementFile, conn remoteexec.Connection, vars map[string]string, opts Options) (string, error) {
+	conn, err := remoteexec.ResolveConnection(conn)
+	if err != nil {
+		return "", err
+	}
+	err = validator.ValidateParams(fmt.Sprintf(
 		`[
 			{"name":"username","value":"%s","validate":["NotEmpty"]},
 			{"name":"target","value":"%s","validate":["NotEmpty"]},
 			{"name":"port","value":"%s","validate":["NotEmpty","IsNumber"]}
 		 ]`,
-		username,
-		target,
-		port,
+		conn.Username,
+		conn.Target,
+		conn.Port,
 	))
 	if err != nil {
 		return "", err
 	}
-	sout, serr, ec, err := remoteexec.RunSSHCommand("$HOME/.lookout/bin/lookout react local --stdin", string(raw_data), username, target, port)
+	err = shipImplements(conn, impl_files)
+	if err != nil {
+		return "", err
+	}
+	command, stdin := clientCommand("$HOME/.lookout/bin/lookout react local --stdin --no-download", raw_data, vars, opts)
+	sout, serr, ec, err := remoteexec.RunSSHCommand(command, stdin, conn)
 	if err != nil {
+		// Anything other than a shell error means the command never
+		// ran, like a host key or auth failure, and the error is more
+		// useful than a generic shell error
+		if _, ran := err.(*errtype.RemoteShellError); !ran {
+			return sout, err
+		}
 		origin := err
 		if errtype_origin, ok := origin.(*errtype.RemoteShellError); ok {
 			origin = errtype_origin.Origin
@@ -40,15 +60,56 @@ func React(raw_data []byte, username string, target string, port string) (string
 	return sout, nil
 }
 
-func CLIReact(maybe_file string, username string, target string, port string) error {
-	raw_data, err := localdata.ReadFileOrStdin(maybe_file)
+// CLIReact prints the results from a single target with the version
+// of its lookout client added. Anything that could select more
+// than one target (see inventory.IsSelector) combines them with
+// ReactFleet, even when it only matched one, so the shape of the
+// output only depends on what was asked for
+func CLIReact(maybe_files []string, raw_targets string, conn remoteexec.Connection, opts Options) error {
+	targets, err := SelectTargets(raw_targets, conn, opts)
+	if err != nil {
+		return err
+	}
+	raw_data, data, err := readSpec(maybe_files)
 	if err != nil {
 		return err
 	}
-	sout, err := React(raw_data, username, target, port)
+	impl_files, err := ResolveImplements(data)
+	if err != nil {
+		return err
+	}
+	if inventory.IsSelector(raw_targets) {
+		results := ReactFleet(raw_data, data, impl_files, targets, opts)
+		if !opts.No_History {
+			for target, result := range results.Targets {
+				if result.Succeeded {
+					history.RecordReactions(target, *result.Results, opts.History_Days)
+				}
+			}
+		}
+		return local.WorstFailure(
+			printFleet(results, results.Total_Targets, results.Failed_Targets, opts),
+			reactionsFailure(results, opts.Fail_On),
+		)
+	}
+	output := runOnTarget(data, targets[0], opts, func(vars map[string]string) (string, error) {
+		return React(raw_data, impl_files, targets[0].Connection, vars, opts)
+	})
+	if output.err != nil {
+		return output.err
+	}
+	var results operation.ReactionResults
+	err = json.Unmarshal([]byte(output.output), &results)
+	if err != nil {
+		return invalidJSON(output.output, err)
+	}
+	results.Remote_Version = output.remote_version
+	if !opts.No_History {
+		history.RecordReactions(targets[0].Name, results, opts.History_Days)
+	}
+	err = render.Print(results, opts.Output)
 	if err != nil {
 		return err
 	}
-	fmt.Printf("%s", sout)
-	return nil
+	return local.ReactionsFailure(results, opts.Fail_On)
 }
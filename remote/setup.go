@@ -11,16 +11,20 @@ import (
 	"github.com/mcdonaldseanp/lookout/version"
 )
 
-func Setup(username string, target string, port string) (string, string, error) {
-	err := validator.ValidateParams(fmt.Sprintf(
+func Setup(conn remoteexec.Connection) (string, string, error) {
+	conn, err := remoteexec.ResolveConnection(conn)
+	if err != nil {
+		return "", "", err
+	}
+	err = validator.ValidateParams(fmt.Sprintf(
 		`[
 			{"name":"username","value":"%s","validate":["NotEmpty"]},
 			{"name":"target","value":"%s","validate":["NotEmpty"]},
 			{"name":"port","value":"%s","validate":["NotEmpty","IsNumber"]}
 		 ]`,
-		username,
-		target,
-		port,
+		conn.Username,
+		conn.Target,
+		conn.Port,
 	))
 	if err != nil {
 		return "", "", err
@@ -34,8 +38,14 @@ func Setup(username string, target string, port string) (string, string, error)
 		chmod 755 $HOME/.lookout/bin/lookout 1>&2`,
 		version.ReleaseArtifact("lookout"),
 	)
-	sout, serr, ec, err := remoteexec.RunSSHCommand(command, "", username, target, port)
+	sout, serr, ec, err := remoteexec.RunSSHCommand(command, "", conn)
 	if err != nil {
+		// Anything other than a shell error means the command never
+		// ran, like a host key or auth failure, and the error is more
+		// useful than a generic shell error
+		if _, ran := err.(*errtype.RemoteShellError); !ran {
+			return sout, serr, err
+		}
 		origin := err
 		if errtype_origin, ok := origin.(*errtype.RemoteShellError); ok {
 			origin = errtype_origin.Origin
@@ -51,14 +61,25 @@ func Setup(username string, target string, port string) (string, string, error)
 	return sout, serr, nil
 }
 
-func CLISetup(username string, target string, port string) error {
-	_, serr, err := Setup(username, target, port)
-	if err != nil {
-		return err
-	}
+// CLISetup downloads the released lookout client on the target,
+// or uploads a local binary when upload is set. See Upload
+func CLISetup(conn remoteexec.Connection, upload bool, binary string) error {
 	output := make(map[string]interface{})
+	if upload {
+		checksum, serr, err := Upload(conn, binary)
+		if err != nil {
+			return err
+		}
+		output["checksum"] = checksum
+		output["logs"] = strings.TrimSpace(serr)
+	} else {
+		_, serr, err := Setup(conn)
+		if err != nil {
+			return err
+		}
+		output["logs"] = strings.TrimSpace(serr)
+	}
 	output["ok"] = true
-	output["logs"] = strings.TrimSpace(serr)
 	json_output, json_err := json.Marshal(output)
 	if json_err != nil {
 		return fmt.Errorf("could not render result as JSON: %s", json_err)
@@ -0,0 +1,105 @@
+package remote
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/mcdonaldseanp/lookout/local"
+	"github.com/mcdonaldseanp/lookout/localdata"
+	"github.com/mcdonaldseanp/lookout/operation"
+	"github.com/mcdonaldseanp/lookout/operparse"
+)
+
+// Reads every spec file and merges them into one stream to send to
+// the remote lookout client.
+//
+// The spec is parsed locally first: the remote client only sees
+// stdin, so any conflict between files is reported here where the
+// file names are still known. The parsed spec is returned too
+// so that variables can be checked for each target
+func readSpec(maybe_files []string) ([]byte, *operation.Operations, error) {
+	sources, err := localdata.ReadFilesOrStdin(maybe_files)
+	if err != nil {
+		return nil, nil, err
+	}
+	var data operation.Operations
+	err = operparse.ParseSources(sources, &data)
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, err := operparse.OrderReactions(data.Reactions); err != nil {
+		return nil, nil, err
+	}
+	return localdata.JoinSources(sources), &data, nil
+}
+
+// targetVars merges the variables for a target that the remote
+// client can't know about itself: inventory vars, LOOKOUT_VAR_
+// environment variables from this machine and --var. They are
+// checked against the spec here so that undefined variables are
+// caught before connecting
+func targetVars(data *operation.Operations, target Target, opts Options) (map[string]string, error) {
+	vars := operparse.MergeVars(target.Vars, operparse.EnvVars(os.Environ()), opts.Vars)
+	_, err := operparse.ApplyVars(data, operparse.MergeVars(data.Vars, vars))
+	if err != nil {
+		return nil, err
+	}
+	return vars, nil
+}
+
+func shellQuote(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", `'\''`) + "'"
+}
+
+// The lookout client on a target reads the sudo password and the
+// variables from these environment variables, see clientCommand
+const (
+	BECOME_PASSWORD_ENV string = "LOOKOUT_BECOME_PASSWORD"
+	VARS_ENV            string = "LOOKOUT_VARS"
+)
+
+// clientCommand builds the command that runs the lookout client on a
+// target and what to send it on stdin. The sudo password and the
+// variables are sent on the first lines of stdin ahead of the spec,
+// so that they never show up in the process list on the target.
+// Variables are sent as a single line of JSON and take precedence
+// over anything set on the target
+func clientCommand(command string, raw_data []byte, vars map[string]string, opts Options) (string, string) {
+	// Results are checked against --fail-on and recorded in the
+	// history here once they're back, so the client exiting
+	// non-zero would only hide them
+	command += " --fail-on " + local.FAIL_ON_NEVER + " --no-history"
+	if opts.Plan {
+		command += " --plan"
+	}
+	if opts.Become {
+		command += " --become"
+	}
+	if opts.Become_User != "" {
+		command += " --become-user " + shellQuote(opts.Become_User)
+	}
+	stdin := string(raw_data)
+	if len(vars) > 0 {
+		// A map of strings always marshals
+		json_vars, _ := json.Marshal(vars)
+		command = fmt.Sprintf("IFS= read -r %s && export %s && %s --vars-env %s",
+			VARS_ENV,
+			VARS_ENV,
+			command,
+			VARS_ENV,
+		)
+		stdin = string(json_vars) + "\n" + stdin
+	}
+	if opts.Become_Password != nil {
+		command = fmt.Sprintf("IFS= read -r %s && export %s && %s --become-password-env %s",
+			BECOME_PASSWORD_ENV,
+			BECOME_PASSWORD_ENV,
+			command,
+			BECOME_PASSWORD_ENV,
+		)
+		stdin = string(opts.Become_Password) + "\n" + stdin
+	}
+	return command, stdin
+}
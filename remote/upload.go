@@ -0,0 +1,227 @@
+package remote
+
+import (
+	"crypto/sha256"
+	"debug/elf"
+	"debug/macho"
+	"debug/pe"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/mcdonaldseanp/clibuild/errtype"
+	"github.com/mcdonaldseanp/clibuild/validator"
+	"github.com/mcdonaldseanp/lookout/remoteexec"
+)
+
+// GOOS/GOARCH names for what uname prints on the target
+var UNAME_OS = map[string]string{
+	"Linux":   "linux",
+	"Darwin":  "darwin",
+	"FreeBSD": "freebsd",
+	"OpenBSD": "openbsd",
+	"NetBSD":  "netbsd",
+}
+
+var UNAME_ARCH = map[string]string{
+	"x86_64":  "amd64",
+	"amd64":   "amd64",
+	"aarch64": "arm64",
+	"arm64":   "arm64",
+	"armv6l":  "arm",
+	"armv7l":  "arm",
+	"i386":    "386",
+	"i686":    "386",
+	"ppc64":   "ppc64",
+	"ppc64le": "ppc64le",
+	"s390x":   "s390x",
+	"riscv64": "riscv64",
+}
+
+// binaryPlatform reads the GOOS and GOARCH a binary was built for
+// from its headers
+func binaryPlatform(binary string) (string, string, error) {
+	if file, err := elf.Open(binary); err == nil {
+		defer file.Close()
+		goos := "linux"
+		switch file.OSABI {
+		case elf.ELFOSABI_FREEBSD:
+			goos = "freebsd"
+		case elf.ELFOSABI_NETBSD:
+			goos = "netbsd"
+		case elf.ELFOSABI_OPENBSD:
+			goos = "openbsd"
+		}
+		goarch := map[elf.Machine]string{
+			elf.EM_X86_64:  "amd64",
+			elf.EM_AARCH64: "arm64",
+			elf.EM_ARM:     "arm",
+			elf.EM_386:     "386",
+			elf.EM_PPC64:   "ppc64le",
+			elf.EM_S390:    "s390x",
+			elf.EM_RISCV:   "riscv64",
+		}[file.Machine]
+		// Both ppc64 and ppc64le are EM_PPC64, only the byte
+		// order tells them apart
+		if file.Machine == elf.EM_PPC64 && file.Data == elf.ELFDATA2MSB {
+			goarch = "ppc64"
+		}
+		return goos, goarch, nil
+	}
+	if file, err := macho.Open(binary); err == nil {
+		defer file.Close()
+		goarch := map[macho.Cpu]string{
+			macho.CpuAmd64: "amd64",
+			macho.CpuArm64: "arm64",
+		}[file.Cpu]
+		return "darwin", goarch, nil
+	}
+	if file, err := pe.Open(binary); err == nil {
+		defer file.Close()
+		goarch := map[uint16]string{
+			pe.IMAGE_FILE_MACHINE_AMD64: "amd64",
+			pe.IMAGE_FILE_MACHINE_ARM64: "arm64",
+			pe.IMAGE_FILE_MACHINE_I386:  "386",
+		}[file.Machine]
+		return "windows", goarch, nil
+	}
+	return "", "", fmt.Errorf("%s is not an executable lookout can upload", binary)
+}
+
+// targetPlatform asks the target for its OS and architecture
+func targetPlatform(conn remoteexec.Connection) (string, string, error) {
+	sout, _, _, err := remoteexec.RunSSHCommand("uname -s -m", "", conn)
+	if err != nil {
+		if _, ran := err.(*errtype.RemoteShellError); !ran {
+			return "", "", err
+		}
+		return "", "", fmt.Errorf("failed to find the OS and architecture of %s, only targets with uname are supported:\n%s", conn.Target, err)
+	}
+	fields := strings.Fields(sout)
+	if len(fields) != 2 {
+		return "", "", fmt.Errorf("failed to find the OS and architecture of %s, uname printed '%s'", conn.Target, strings.TrimSpace(sout))
+	}
+	goos, found := UNAME_OS[fields[0]]
+	if !found {
+		return "", "", fmt.Errorf("target %s runs %s, which lookout does not support", conn.Target, fields[0])
+	}
+	goarch, found := UNAME_ARCH[fields[1]]
+	if !found {
+		return "", "", fmt.Errorf("target %s has architecture %s, which lookout does not support", conn.Target, fields[1])
+	}
+	return goos, goarch, nil
+}
+
+// Upload pushes a lookout binary to the target over ssh instead of
+// downloading a release on the target. The binary has to be built
+// for the target's OS and architecture, and is only moved into place
+// once the checksum on the target matches. An empty binary uploads
+// the lookout that is running
+func Upload(conn remoteexec.Connection, binary string) (string, string, error) {
+	conn, err := remoteexec.ResolveConnection(conn)
+	if err != nil {
+		return "", "", err
+	}
+	err = validator.ValidateParams(fmt.Sprintf(
+		`[
+			{"name":"username","value":"%s","validate":["NotEmpty"]},
+			{"name":"target","value":"%s","validate":["NotEmpty"]},
+			{"name":"port","value":"%s","validate":["NotEmpty","IsNumber"]}
+		 ]`,
+		conn.Username,
+		conn.Target,
+		conn.Port,
+	))
+	if err != nil {
+		return "", "", err
+	}
+	if binary == "" {
+		executable, err := os.Executable()
+		if err != nil {
+			return "", "", fmt.Errorf("failed to find the running lookout binary:\n%s", err)
+		}
+		binary = executable
+	}
+	goos, goarch, err := binaryPlatform(binary)
+	if err != nil {
+		return "", "", err
+	}
+	target_os, target_arch, err := targetPlatform(conn)
+	if err != nil {
+		return "", "", err
+	}
+	if goos != target_os || goarch != target_arch {
+		return "", "", &errtype.InvalidInput{
+			Message: fmt.Sprintf("%s is built for %s/%s but target %s is %s/%s", binary, goos, goarch, conn.Target, target_os, target_arch),
+			Origin:  nil,
+		}
+	}
+	raw_binary, err := os.ReadFile(binary)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to read %s:\n%s", binary, err)
+	}
+	checksum := sha256Sum(raw_binary)
+	sout, serr, ec, err := streamFile(conn, ".lookout/bin/lookout", raw_binary, checksum)
+	if err != nil {
+		if _, ran := err.(*errtype.RemoteShellError); !ran {
+			return sout, serr, err
+		}
+		origin := err
+		if errtype_origin, ok := origin.(*errtype.RemoteShellError); ok {
+			origin = errtype_origin.Origin
+		}
+		return sout, serr, &errtype.RemoteShellError{
+			Message: fmt.Sprintf("attempt to upload lookout client to remote target returned non-zero exit code %d\n\nStdout:\n%s\nStderr:\n%s\n",
+				ec,
+				sout,
+				serr),
+			Origin: origin,
+		}
+	}
+	return checksum, serr, nil
+}
+
+func sha256Sum(raw_data []byte) string {
+	sum := sha256.Sum256(raw_data)
+	return hex.EncodeToString(sum[:])
+}
+
+// Prints the sha256 of the files given as arguments
+const SHA256_COMMAND string = `$(if command -v sha256sum > /dev/null 2>&1; then echo sha256sum; else echo shasum -a 256; fi)`
+
+// streamFile copies raw_data over stdin to destination, relative to
+// $HOME on the target. The data goes to a temporary file first and is
+// only moved into place once its checksum matches, so that a failed
+// copy never replaces a working file
+func streamFile(conn remoteexec.Connection, destination string, raw_data []byte, checksum string) (string, string, int, error) {
+	command := fmt.Sprintf(
+		`#!/usr/bin/env bash
+
+		destination="$HOME"/%s
+		mkdir -p "$(dirname "$destination")" 1>&2
+		upload="$destination.upload"
+		cat > "$upload"
+		checksum=$(%s "$upload" | cut -d ' ' -f 1)
+		echo "$checksum"
+		if [ "$checksum" != "%s" ]; then
+			rm -f "$upload"
+			echo "checksum of $destination does not match, expected %s got $checksum" 1>&2
+			exit 3
+		fi
+		chmod 755 "$upload" 1>&2
+		mv "$upload" "$destination" 1>&2`,
+		shellQuote(destination),
+		SHA256_COMMAND,
+		checksum,
+		checksum,
+	)
+	sout, serr, ec, err := remoteexec.RunSSHCommand(command, string(raw_data), conn)
+	if err != nil {
+		return sout, serr, ec, err
+	}
+	if strings.TrimSpace(sout) != checksum {
+		return sout, serr, ec, fmt.Errorf("checksum of %s on target %s does not match, expected %s got %s", destination, conn.Target, checksum, strings.TrimSpace(sout))
+	}
+	return sout, serr, ec, nil
+}
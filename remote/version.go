@@ -0,0 +1,91 @@
+package remote
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/mcdonaldseanp/clibuild/errtype"
+	"github.com/mcdonaldseanp/lookout/remoteexec"
+	"github.com/mcdonaldseanp/lookout/version"
+)
+
+// What to do when the lookout client on a target isn't the same
+// version as this one. An older client usually fails on newer specs
+// with strict yaml errors that don't say why
+const (
+	VERSION_CHECK_REFUSE  string = "refuse"
+	VERSION_CHECK_WARN    string = "warn"
+	VERSION_CHECK_UPGRADE string = "upgrade"
+)
+
+var VERSION_CHECKS = []string{VERSION_CHECK_REFUSE, VERSION_CHECK_WARN, VERSION_CHECK_UPGRADE}
+
+// remoteVersion returns the version of the lookout client on the
+// target, or an empty string when it isn't installed
+func remoteVersion(conn remoteexec.Connection) (string, error) {
+	command := `if [ -x $HOME/.lookout/bin/lookout ]; then $HOME/.lookout/bin/lookout --version; fi`
+	sout, serr, ec, err := remoteexec.RunSSHCommand(command, "", conn)
+	if err != nil {
+		if _, ran := err.(*errtype.RemoteShellError); !ran {
+			return "", err
+		}
+		return "", fmt.Errorf("failed to find the version of the lookout client on %s, exit code %d\n\nStdout:\n%s\nStderr:\n%s\n",
+			conn.Target,
+			ec,
+			sout,
+			serr)
+	}
+	return strings.TrimSpace(sout), nil
+}
+
+// checkVersion compares the lookout client on the target with this
+// one before anything runs there, and returns the remote version.
+// See the VERSION_CHECK modes for what happens when they differ.
+// Upgrades upload a binary when opts.Upgrade_Upload is set, and
+// otherwise download a release the same way setup remote does
+func checkVersion(conn remoteexec.Connection, opts Options) (string, error) {
+	conn, err := remoteexec.ResolveConnection(conn)
+	if err != nil {
+		return "", err
+	}
+	remote_version, err := remoteVersion(conn)
+	if err != nil {
+		return "", err
+	}
+	if remote_version == version.VERSION {
+		return remote_version, nil
+	}
+	var problem string
+	if remote_version == "" {
+		problem = fmt.Sprintf("lookout client is not installed on target %s", conn.Target)
+	} else {
+		problem = fmt.Sprintf("lookout client on target %s is %s but this lookout is %s", conn.Target, remote_version, version.VERSION)
+	}
+	switch opts.Version_Check {
+	case VERSION_CHECK_UPGRADE:
+		if opts.Upgrade_Upload {
+			_, _, err = Upload(conn, opts.Upgrade_Binary)
+		} else {
+			_, _, err = Setup(conn)
+		}
+		if err != nil {
+			return "", fmt.Errorf("%s, and upgrading it failed:\n%s", problem, err)
+		}
+		remote_version, err = remoteVersion(conn)
+		if err != nil {
+			return "", err
+		}
+		if remote_version != version.VERSION {
+			return "", fmt.Errorf("%s, and after upgrading it reports version '%s'", problem, remote_version)
+		}
+		return remote_version, nil
+	case VERSION_CHECK_WARN:
+		// Without a client there's nothing to warn about, it can't run
+		if remote_version != "" {
+			fmt.Fprintf(os.Stderr, "Warning: %s\n", problem)
+			return remote_version, nil
+		}
+	}
+	return "", fmt.Errorf("%s, run 'lookout setup remote %s' or use --version-check %s", problem, conn.Target, VERSION_CHECK_UPGRADE)
+}
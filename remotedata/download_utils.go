@@ -3,7 +3,6 @@ package remotedata
 import (
 	"fmt"
 	"io"
-	"log"
 	"net/http"
 )
 
@@ -30,9 +29,12 @@ func readBody(resp http.Response) ([]byte, error) {
 func Download(url string) ([]byte, error) {
 	resp, err := http.Get(url)
 	if err != nil {
-		log.Fatal(err)
+		return nil, fmt.Errorf("failed to download %s:\n%s", url, err)
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, fmt.Errorf("failed to download %s: server returned %s", url, resp.Status)
+	}
 	data, arr := readBody(*resp)
 	if arr != nil {
 		return nil, arr
@@ -0,0 +1,192 @@
+package remoteexec
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+
+	"github.com/mcdonaldseanp/lookout/localdata"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// Keys that are tried when no identity file is given, in the same
+// order ssh uses them
+var DEFAULT_IDENTITIES = []string{"id_ed25519", "id_ecdsa", "id_rsa"}
+
+// agentClient returns nil when there's no usable agent, so that
+// only the other keys are tried. The agent connection is returned
+// as well, and has to be closed once the handshake is done
+func agentClient() (agent.ExtendedAgent, net.Conn) {
+	socket := os.Getenv("SSH_AUTH_SOCK")
+	if socket == "" {
+		return nil, nil
+	}
+	agent_conn, err := net.Dial("unix", socket)
+	if err != nil {
+		return nil, nil
+	}
+	return agent.NewClient(agent_conn), agent_conn
+}
+
+func parseIdentity(identity_file string, passphrase []byte) (ssh.Signer, error) {
+	raw_key, err := os.ReadFile(identity_file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read identity file %s:\n%s", identity_file, err)
+	}
+	signer, err := ssh.ParsePrivateKey(raw_key)
+	var missing *ssh.PassphraseMissingError
+	if errors.As(err, &missing) {
+		if passphrase == nil {
+			return nil, fmt.Errorf("identity file %s is protected by a passphrase, use --identity-passphrase-env or --identity-passphrase-file", identity_file)
+		}
+		signer, err = ssh.ParsePrivateKeyWithPassphrase(raw_key, passphrase)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load identity file %s:\n%s", identity_file, err)
+	}
+	return signer, nil
+}
+
+// certifiedSigner uses an OpenSSH user certificate with the key when
+// there is one, either given directly or next to the identity file
+// with the same -cert.pub name ssh looks for
+func certifiedSigner(signer ssh.Signer, identity_file string, certificate_file string) (ssh.Signer, error) {
+	if certificate_file == "" {
+		certificate_file = identity_file + "-cert.pub"
+		if _, err := os.Stat(certificate_file); err != nil {
+			return signer, nil
+		}
+	}
+	raw_cert, err := os.ReadFile(certificate_file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read certificate %s:\n%s", certificate_file, err)
+	}
+	public_key, _, _, _, err := ssh.ParseAuthorizedKey(raw_cert)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse certificate %s:\n%s", certificate_file, err)
+	}
+	cert, ok := public_key.(*ssh.Certificate)
+	if !ok {
+		return nil, fmt.Errorf("%s is not an ssh certificate", certificate_file)
+	}
+	cert_signer, err := ssh.NewCertSigner(cert, signer)
+	if err != nil {
+		return nil, fmt.Errorf("certificate %s does not match identity file %s:\n%s", certificate_file, identity_file, err)
+	}
+	return cert_signer, nil
+}
+
+// identitySigners loads the identity file. Without one, the
+// IdentityFile keys from the ssh config file or the default keys
+// in ~/.ssh are used instead, and keys that can't be loaded are
+// skipped since the user never asked for them directly
+func identitySigners(conn Connection) ([]ssh.Signer, error) {
+	passphrase, err := localdata.ReadSecret(conn.Passphrase_Env, conn.Passphrase_File)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read identity passphrase: %s", err)
+	}
+	if conn.Identity_File != "" {
+		// Identity files from an inventory haven't been through a shell
+		identity_file := expandConfigPath(conn.Identity_File, nil, nil)
+		signer, err := parseIdentity(identity_file, passphrase)
+		if err != nil {
+			return nil, err
+		}
+		signer, err = certifiedSigner(signer, identity_file, conn.Certificate_File)
+		if err != nil {
+			return nil, err
+		}
+		return []ssh.Signer{signer}, nil
+	}
+	if conn.Certificate_File != "" {
+		return nil, fmt.Errorf("a certificate can only be used with --identity-file")
+	}
+	identity_files := conn.Identity_Files
+	if len(identity_files) < 1 {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, nil
+		}
+		for _, name := range DEFAULT_IDENTITIES {
+			identity_files = append(identity_files, filepath.Join(home, ".ssh", name))
+		}
+	}
+	signers := []ssh.Signer{}
+	for _, identity_file := range identity_files {
+		if _, err := os.Stat(identity_file); err != nil {
+			continue
+		}
+		signer, err := parseIdentity(identity_file, passphrase)
+		if err != nil {
+			continue
+		}
+		signer, err = certifiedSigner(signer, identity_file, "")
+		if err != nil {
+			continue
+		}
+		signers = append(signers, signer)
+	}
+	return signers, nil
+}
+
+// authMethods builds the auth methods in the order they are tried:
+// keys from the agent then identity files, then password and
+// keyboard-interactive when a password was given. The returned
+// function closes the connection to the agent, and must be called
+// after the handshake.
+//
+// The agent and identity file keys have to be one method, because
+// ssh never tries a second publickey method once one has failed
+func authMethods(conn Connection) ([]ssh.AuthMethod, func(), error) {
+	methods := []ssh.AuthMethod{}
+	done := func() {}
+	agent_client, agent_conn := agentClient()
+	if agent_client != nil {
+		done = func() { agent_conn.Close() }
+	}
+	signers, err := identitySigners(conn)
+	if err != nil {
+		done()
+		return nil, nil, err
+	}
+	if agent_client != nil || len(signers) > 0 {
+		// Use a callback rather than PublicKeys so we only consult the
+		// agent once the remote server wants it. An agent that can't
+		// list its keys still leaves the identity files to try
+		methods = append(methods, ssh.PublicKeysCallback(func() ([]ssh.Signer, error) {
+			all_signers := []ssh.Signer{}
+			if agent_client != nil {
+				if agent_signers, err := agent_client.Signers(); err == nil {
+					all_signers = append(all_signers, agent_signers...)
+				}
+			}
+			return append(all_signers, signers...), nil
+		}))
+	}
+	password, err := localdata.ReadSecret(conn.Password_Env, conn.Password_File)
+	if err != nil {
+		done()
+		return nil, nil, fmt.Errorf("failed to read ssh password: %s", err)
+	}
+	if password != nil {
+		methods = append(methods,
+			ssh.Password(string(password)),
+			// Servers that use PAM usually ask for the password through
+			// keyboard-interactive, so answer every prompt with it
+			ssh.KeyboardInteractive(func(user string, instruction string, questions []string, echos []bool) ([]string, error) {
+				answers := make([]string, len(questions))
+				for index := range questions {
+					answers[index] = string(password)
+				}
+				return answers, nil
+			}),
+		)
+	}
+	if len(methods) < 1 {
+		return nil, nil, fmt.Errorf("no ssh authentication available: start an ssh agent, or use --identity-file or --password-env")
+	}
+	return methods, done, nil
+}
@@ -0,0 +1,170 @@
+package remoteexec
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+const (
+	// Only connect to hosts that are already in known_hosts
+	HOST_KEY_STRICT string = "strict"
+	// Trust on first use: hosts that aren't in known_hosts are
+	// added to it, but a host whose key changed is still rejected
+	HOST_KEY_ACCEPT_NEW string = "accept-new"
+)
+
+// HostKeyError is returned when a target's host key can't be
+// verified against known_hosts. Mismatch is true when known_hosts
+// has a different key for the host, and false when the host isn't
+// in known_hosts at all
+type HostKeyError struct {
+	Host        string
+	Known_Hosts string
+	Fingerprint string
+	Mismatch    bool
+}
+
+func (hk *HostKeyError) Error() string {
+	if hk.Mismatch {
+		return fmt.Sprintf(
+			"host key verification failed\nthe host key for %s (%s) does not match the key in %s\n"+
+				"the host key may have changed, or someone may be intercepting the connection\n",
+			hk.Host,
+			hk.Fingerprint,
+			hk.Known_Hosts,
+		)
+	}
+	return fmt.Sprintf(
+		"host key verification failed\n%s (%s) is not in %s\n"+
+			"connect to it with ssh first, or use --host-key-check %s to trust it on first use\n",
+		hk.Host,
+		hk.Fingerprint,
+		hk.Known_Hosts,
+		HOST_KEY_ACCEPT_NEW,
+	)
+}
+
+func defaultKnownHosts() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		home = os.Getenv("HOME")
+	}
+	return filepath.Join(home, ".ssh", "known_hosts")
+}
+
+// Only accept-new is allowed to create the known_hosts file, in
+// strict mode a missing file means that no hosts are known
+func openKnownHosts(known_hosts string, mode string) (ssh.HostKeyCallback, error) {
+	if _, err := os.Stat(known_hosts); errors.Is(err, os.ErrNotExist) {
+		if mode == HOST_KEY_STRICT {
+			return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+				return &knownhosts.KeyError{}
+			}, nil
+		}
+		err = os.MkdirAll(filepath.Dir(known_hosts), 0700)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create directory for %s:\n%s", known_hosts, err)
+		}
+		f, err := os.OpenFile(known_hosts, os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create %s:\n%s", known_hosts, err)
+		}
+		f.Close()
+	}
+	check, err := knownhosts.New(known_hosts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read known hosts file %s:\n%s", known_hosts, err)
+	}
+	return check, nil
+}
+
+func appendKnownHost(known_hosts string, hostname string, key ssh.PublicKey) error {
+	f, err := os.OpenFile(known_hosts, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open %s:\n%s", known_hosts, err)
+	}
+	defer f.Close()
+	_, err = f.WriteString(knownhosts.Line([]string{knownhosts.Normalize(hostname)}, key) + "\n")
+	if err != nil {
+		return fmt.Errorf("failed to add %s to %s:\n%s", hostname, known_hosts, err)
+	}
+	return nil
+}
+
+// A placeholder key that is never in known_hosts, used to find
+// out which keys known_hosts does have for a host
+type probeKey struct{}
+
+func (pk probeKey) Type() string                                 { return "lookout-probe" }
+func (pk probeKey) Marshal() []byte                              { return []byte("lookout-probe") }
+func (pk probeKey) Verify(data []byte, sig *ssh.Signature) error { return fmt.Errorf("probe key") }
+
+// Servers usually have several host keys. If the server offers a key
+// type that isn't in known_hosts it looks exactly like a changed key,
+// so only ask the server for key types that known_hosts already has.
+// Hosts that aren't known get nil, which lets the client offer its defaults
+func knownHostKeyAlgorithms(check ssh.HostKeyCallback, hostport string) []string {
+	var algorithms []string
+	err := check(hostport, &net.TCPAddr{IP: net.IPv4zero}, probeKey{})
+	var key_err *knownhosts.KeyError
+	if !errors.As(err, &key_err) {
+		return nil
+	}
+	for _, known := range key_err.Want {
+		switch known.Key.Type() {
+		case ssh.KeyAlgoRSA:
+			// RSA keys can be used with the newer SHA-2 signature algorithms
+			algorithms = append(algorithms, ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA)
+		default:
+			algorithms = append(algorithms, known.Key.Type())
+		}
+	}
+	return algorithms
+}
+
+// hostKeyCallback verifies host keys against known_hosts. The
+// returned error pointer is filled in when verification fails,
+// because ssh.Dial flattens callback errors into plain strings
+func hostKeyCallback(known_hosts string, mode string, hostport string) (ssh.HostKeyCallback, []string, *error, error) {
+	if known_hosts == "" {
+		known_hosts = defaultKnownHosts()
+	}
+	if mode == "" {
+		mode = HOST_KEY_STRICT
+	}
+	if mode != HOST_KEY_STRICT && mode != HOST_KEY_ACCEPT_NEW {
+		return nil, nil, nil, fmt.Errorf("unknown host key check '%s', must be one of: %s, %s", mode, HOST_KEY_STRICT, HOST_KEY_ACCEPT_NEW)
+	}
+	check, err := openKnownHosts(known_hosts, mode)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	var verify_err error
+	callback := func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		err := check(hostname, remote, key)
+		var key_err *knownhosts.KeyError
+		if errors.As(err, &key_err) {
+			if len(key_err.Want) < 1 && mode == HOST_KEY_ACCEPT_NEW {
+				return appendKnownHost(known_hosts, hostname, key)
+			}
+			verify_err = &HostKeyError{
+				Host:        hostname,
+				Known_Hosts: known_hosts,
+				Fingerprint: ssh.FingerprintSHA256(key),
+				Mismatch:    len(key_err.Want) > 0,
+			}
+			return verify_err
+		}
+		if err != nil {
+			verify_err = fmt.Errorf("host key verification failed for %s:\n%s", hostname, err)
+		}
+		return err
+	}
+	return callback, knownHostKeyAlgorithms(check, hostport), &verify_err, nil
+}
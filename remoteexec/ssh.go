@@ -4,42 +4,201 @@ import (
 	"bytes"
 	"fmt"
 	"net"
-	"os"
 	"strings"
 
 	"github.com/mcdonaldseanp/clibuild/errtype"
 	"github.com/mcdonaldseanp/lookout/sanitize"
 	"golang.org/x/crypto/ssh"
-	"golang.org/x/crypto/ssh/agent"
 )
 
-// Based on https://pkg.go.dev/golang.org/x/crypto/ssh/agent#example-NewClient
-func openConnectionWithAgent(username string, target string, port string) (*ssh.Client, error) {
-	socket := os.Getenv("SSH_AUTH_SOCK")
-	conn, err := net.Dial("unix", socket)
+// Everything needed to open an SSH connection to a target. Use
+// ResolveConnection to fill in the values from ~/.ssh/config
+type Connection struct {
+	Username string
+	Target   string
+	Port     string
+	// The address to connect to when Target is an alias from the
+	// ssh config file, defaults to Target
+	Host_Name string
+	// Path to the ssh config file, defaults to ~/.ssh/config.
+	// "none" doesn't read a config file
+	SSH_Config string
+	// Comma separated jump hosts to connect through, each one
+	// [user@]host[:port]. "none" doesn't use any jump hosts
+	Proxy_Jump string
+	// Path to the known_hosts file, defaults to ~/.ssh/known_hosts
+	Known_Hosts string
+	// One of HOST_KEY_STRICT or HOST_KEY_ACCEPT_NEW, defaults to strict
+	Host_Key_Check string
+	// Private key to authenticate with, defaults to the keys in ~/.ssh.
+	// The passphrase for it is read from an environment variable or file
+	Identity_File   string
+	Passphrase_Env  string
+	Passphrase_File string
+	// IdentityFile values from the ssh config file, which are used
+	// instead of the default keys when there's no Identity_File
+	Identity_Files []string
+	// OpenSSH user certificate for the identity file, defaults to
+	// the identity file name with -cert.pub if that exists
+	Certificate_File string
+	// Password for password and keyboard-interactive auth, read from
+	// an environment variable or file
+	Password_Env  string
+	Password_File string
+}
+
+func (conn Connection) hostPort() string {
+	host := conn.Host_Name
+	if host == "" {
+		host = conn.Target
+	}
+	return net.JoinHostPort(host, conn.Port)
+}
+
+// jumpHosts turns the connection's ProxyJump into the list of hosts
+// to connect through, in order. Jump hosts are looked up in the ssh
+// config file too, and when the first jump host has its own ProxyJump
+// those hosts come before it
+func jumpHosts(conn Connection, seen map[string]bool) ([]Connection, error) {
+	if conn.Proxy_Jump == "" {
+		return nil, nil
+	}
+	hops := []Connection{}
+	for index, spec := range strings.Split(conn.Proxy_Jump, ",") {
+		spec = strings.TrimSpace(spec)
+		jump := Connection{
+			SSH_Config:       conn.SSH_Config,
+			Known_Hosts:      conn.Known_Hosts,
+			Host_Key_Check:   conn.Host_Key_Check,
+			Passphrase_Env:   conn.Passphrase_Env,
+			Passphrase_File:  conn.Passphrase_File,
+			Password_Env:     conn.Password_Env,
+			Password_File:    conn.Password_File,
+			Identity_File:    conn.Identity_File,
+			Certificate_File: conn.Certificate_File,
+		}
+		if at := strings.LastIndex(spec, "@"); at >= 0 {
+			jump.Username = spec[:at]
+			spec = spec[at+1:]
+		}
+		jump.Target = spec
+		if host, port, err := net.SplitHostPort(spec); err == nil {
+			jump.Target = host
+			jump.Port = port
+		}
+		if jump.Target == "" {
+			return nil, fmt.Errorf("invalid jump host '%s' for %s", spec, conn.Target)
+		}
+		if seen[jump.Target] {
+			return nil, fmt.Errorf("jump host '%s' for %s is used more than once, check ProxyJump in the ssh config file for a loop", jump.Target, conn.Target)
+		}
+		seen[jump.Target] = true
+		jump, err := ResolveConnection(jump)
+		if err != nil {
+			return nil, err
+		}
+		if index == 0 {
+			before, err := jumpHosts(jump, seen)
+			if err != nil {
+				return nil, err
+			}
+			hops = append(hops, before...)
+		}
+		jump.Proxy_Jump = ""
+		hops = append(hops, jump)
+	}
+	return hops, nil
+}
+
+// dialHost opens an ssh connection to one host, either directly when
+// through is nil or tunneled through an existing connection
+func dialHost(conn Connection, through *ssh.Client) (*ssh.Client, error) {
+	auth_methods, done_auth, err := authMethods(conn)
 	if err != nil {
-		return nil, fmt.Errorf("failed to connect to ssh agent")
+		return nil, err
+	}
+	// The agent is only needed for the handshake, which is over by
+	// the time this returns
+	defer done_auth()
+	hostport := conn.hostPort()
+	check_host_key, host_key_algorithms, verify_err, err := hostKeyCallback(conn.Known_Hosts, conn.Host_Key_Check, hostport)
+	if err != nil {
+		return nil, err
 	}
-	agentClient := agent.NewClient(conn)
 	config := &ssh.ClientConfig{
-		User: username,
-		Auth: []ssh.AuthMethod{
-			// Use a callback rather than PublicKeys so we only consult the
-			// agent once the remote server wants it.
-			ssh.PublicKeysCallback(agentClient.Signers),
-		},
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		User:              conn.Username,
+		Auth:              auth_methods,
+		HostKeyCallback:   check_host_key,
+		HostKeyAlgorithms: host_key_algorithms,
 	}
 
-	ssh_client, err := ssh.Dial("tcp", target+":"+port, config)
+	var ssh_client *ssh.Client
+	if through == nil {
+		ssh_client, err = ssh.Dial("tcp", hostport, config)
+	} else {
+		var tunnel net.Conn
+		tunnel, err = through.Dial("tcp", hostport)
+		if err == nil {
+			var client_conn ssh.Conn
+			var channels <-chan ssh.NewChannel
+			var requests <-chan *ssh.Request
+			client_conn, channels, requests, err = ssh.NewClientConn(tunnel, hostport, config)
+			if err == nil {
+				ssh_client = ssh.NewClient(client_conn, channels, requests)
+			} else {
+				tunnel.Close()
+			}
+		}
+	}
 	if err != nil {
-		return nil, fmt.Errorf("failed to open ssh connection to %s", target)
+		if *verify_err != nil {
+			return nil, *verify_err
+		}
+		return nil, fmt.Errorf("failed to open ssh connection to %s:\n%s", conn.Target, err)
 	}
 	return ssh_client, nil
 }
 
-func RunSSHCommand(command string, send_stdin string, username string, target string, port string) (string, string, int, error) {
-	client, err := openConnectionWithAgent(username, target, port)
+// openConnection connects to the target through any jump hosts.
+// The jump host connections are closed once the target connection
+// closes. The ssh agent is tried first when there is one, see
+// authMethods
+func openConnection(conn Connection) (*ssh.Client, error) {
+	hops, err := jumpHosts(conn, map[string]bool{conn.Target: true})
+	if err != nil {
+		return nil, err
+	}
+	hops = append(hops, conn)
+	opened := []*ssh.Client{}
+	closeAll := func() {
+		for index := len(opened) - 1; index >= 0; index-- {
+			opened[index].Close()
+		}
+	}
+	var through *ssh.Client
+	for index, hop := range hops {
+		ssh_client, err := dialHost(hop, through)
+		if err != nil {
+			closeAll()
+			if index < len(hops)-1 {
+				return nil, fmt.Errorf("failed to connect to jump host %s for %s:\n%w", hop.Target, conn.Target, err)
+			}
+			return nil, err
+		}
+		opened = append(opened, ssh_client)
+		through = ssh_client
+	}
+	if len(opened) > 1 {
+		go func() {
+			through.Wait()
+			closeAll()
+		}()
+	}
+	return through, nil
+}
+
+func RunSSHCommand(command string, send_stdin string, conn Connection) (string, string, int, error) {
+	client, err := openConnection(conn)
 	if err != nil {
 		return "", "", -1, err
 	}
@@ -47,7 +206,7 @@ func RunSSHCommand(command string, send_stdin string, username string, target st
 
 	session, err := client.NewSession()
 	if err != nil {
-		return "", "", -1, fmt.Errorf("failed to open new ssh session to %s", target)
+		return "", "", -1, fmt.Errorf("failed to open new ssh session to %s", conn.Target)
 	}
 	defer session.Close()
 	var read_stdout, read_stderr bytes.Buffer
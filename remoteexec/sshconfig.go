@@ -0,0 +1,300 @@
+package remoteexec
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Only one line of an ssh config file, along with the Host
+// patterns of the block it was in. Lines before the first Host
+// line have no patterns and apply to every host
+type sshConfigLine struct {
+	patterns []string
+	keyword  string
+	args     []string
+}
+
+// The values lookout uses from an ssh config file for one host
+type sshHostConfig struct {
+	Host_Name      string
+	User           string
+	Port           string
+	Proxy_Jump     string
+	Identity_Files []string
+}
+
+func defaultSSHConfig() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		home = os.Getenv("HOME")
+	}
+	return filepath.Join(home, ".ssh", "config")
+}
+
+// splitConfigLine splits a line into its keyword and arguments.
+// Keywords can be separated from their arguments with spaces or
+// an =, and arguments can be quoted
+func splitConfigLine(line string) (string, []string, error) {
+	line = strings.TrimSpace(line)
+	end := strings.IndexAny(line, " \t=")
+	if end < 0 {
+		return strings.ToLower(line), nil, nil
+	}
+	keyword := strings.ToLower(line[:end])
+	rest := strings.TrimLeft(line[end:], " \t")
+	rest = strings.TrimPrefix(rest, "=")
+	args := []string{}
+	current := ""
+	in_arg, quoted := false, false
+	for _, char := range rest {
+		switch {
+		case char == '"':
+			quoted = !quoted
+			in_arg = true
+		case (char == ' ' || char == '\t') && !quoted:
+			if in_arg {
+				args = append(args, current)
+			}
+			current, in_arg = "", false
+		default:
+			current += string(char)
+			in_arg = true
+		}
+	}
+	if quoted {
+		return "", nil, fmt.Errorf("unclosed quote in '%s'", line)
+	}
+	if in_arg {
+		args = append(args, current)
+	}
+	return keyword, args, nil
+}
+
+// readSSHConfig reads an ssh config file into lines that can be
+// looked up by host. Include lines are read in place and keep the
+// patterns of the Host block they are in. Match blocks other than
+// "Match all" aren't supported and never apply
+func readSSHConfig(config_file string, patterns []string, depth int) ([]sshConfigLine, error) {
+	if depth > 16 {
+		return nil, fmt.Errorf("too many nested Include lines in %s", config_file)
+	}
+	file, err := os.Open(config_file)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	lines := []sshConfigLine{}
+	scanner := bufio.NewScanner(file)
+	line_number := 0
+	for scanner.Scan() {
+		line_number++
+		raw_line := strings.TrimSpace(scanner.Text())
+		if raw_line == "" || strings.HasPrefix(raw_line, "#") {
+			continue
+		}
+		keyword, args, err := splitConfigLine(raw_line)
+		if err != nil {
+			return nil, fmt.Errorf("%s line %d: %s", config_file, line_number, err)
+		}
+		switch keyword {
+		case "host":
+			if len(args) < 1 {
+				return nil, fmt.Errorf("%s line %d: Host needs at least one pattern", config_file, line_number)
+			}
+			patterns = args
+		case "match":
+			if len(args) == 1 && strings.ToLower(args[0]) == "all" {
+				patterns = []string{"*"}
+			} else {
+				// A pattern that can never match a host name
+				patterns = []string{"!*"}
+			}
+		case "include":
+			for _, include := range args {
+				include = expandConfigPath(include, nil, nil)
+				if !filepath.IsAbs(include) {
+					include = filepath.Join(filepath.Dir(defaultSSHConfig()), include)
+				}
+				matches, err := filepath.Glob(include)
+				if err != nil {
+					return nil, fmt.Errorf("%s line %d: %s", config_file, line_number, err)
+				}
+				for _, match := range matches {
+					included, err := readSSHConfig(match, patterns, depth+1)
+					if err != nil {
+						return nil, err
+					}
+					lines = append(lines, included...)
+				}
+			}
+		default:
+			lines = append(lines, sshConfigLine{patterns: patterns, keyword: keyword, args: args})
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read %s:\n%s", config_file, err)
+	}
+	return lines, nil
+}
+
+// wildcardMatch matches ssh config host patterns, which
+// only have * for any characters and ? for one character
+func wildcardMatch(pattern string, name string) bool {
+	if pattern == "" {
+		return name == ""
+	}
+	switch pattern[0] {
+	case '*':
+		for index := 0; index <= len(name); index++ {
+			if wildcardMatch(pattern[1:], name[index:]) {
+				return true
+			}
+		}
+		return false
+	case '?':
+		return len(name) > 0 && wildcardMatch(pattern[1:], name[1:])
+	default:
+		return len(name) > 0 && pattern[0] == name[0] && wildcardMatch(pattern[1:], name[1:])
+	}
+}
+
+// A host matches a block when it matches one of the patterns and
+// none of the negated (!) patterns
+func hostMatches(patterns []string, host string) bool {
+	if patterns == nil {
+		return true
+	}
+	matched := false
+	for _, pattern := range patterns {
+		if negated := strings.TrimPrefix(pattern, "!"); negated != pattern {
+			if wildcardMatch(negated, host) {
+				return false
+			}
+		} else if wildcardMatch(pattern, host) {
+			matched = true
+		}
+	}
+	return matched
+}
+
+// expandConfigPath expands ~ and the %d, %h, %r and %% tokens
+// ssh supports in IdentityFile paths
+func expandConfigPath(path string, host *string, user *string) string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		home = os.Getenv("HOME")
+	}
+	if path == "~" || strings.HasPrefix(path, "~/") {
+		path = home + path[1:]
+	}
+	replacements := []string{"%%", "%", "%d", home}
+	if host != nil {
+		replacements = append(replacements, "%h", *host)
+	}
+	if user != nil {
+		replacements = append(replacements, "%r", *user)
+	}
+	return strings.NewReplacer(replacements...).Replace(path)
+}
+
+// lookupHost finds the config for a host. Like ssh, the first
+// value found for a keyword is used, except IdentityFile which
+// adds up
+func lookupHost(lines []sshConfigLine, host string) sshHostConfig {
+	host_config := sshHostConfig{}
+	for _, line := range lines {
+		if len(line.args) < 1 || !hostMatches(line.patterns, host) {
+			continue
+		}
+		switch line.keyword {
+		case "hostname":
+			if host_config.Host_Name == "" {
+				host_config.Host_Name = line.args[0]
+			}
+		case "user":
+			if host_config.User == "" {
+				host_config.User = line.args[0]
+			}
+		case "port":
+			if host_config.Port == "" {
+				host_config.Port = line.args[0]
+			}
+		case "proxyjump":
+			if host_config.Proxy_Jump == "" {
+				host_config.Proxy_Jump = strings.Join(line.args, ",")
+			}
+		case "identityfile":
+			host_config.Identity_Files = append(host_config.Identity_Files, line.args[0])
+		}
+	}
+	return host_config
+}
+
+// loadSSHConfig reads the config file for a connection. The default
+// file doesn't have to exist, but one given with --ssh-config does.
+// "none" skips reading a config file, the same as ssh -F none
+func loadSSHConfig(config_file string) ([]sshConfigLine, error) {
+	if config_file == "none" {
+		return nil, nil
+	}
+	explicit := config_file != ""
+	if !explicit {
+		config_file = defaultSSHConfig()
+	}
+	lines, err := readSSHConfig(config_file, nil, 0)
+	if errors.Is(err, os.ErrNotExist) && !explicit {
+		return nil, nil
+	}
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("ssh config file %s does not exist", config_file)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read ssh config file:\n%s", err)
+	}
+	return lines, nil
+}
+
+// ResolveConnection fills in a connection from the ssh config file.
+// Values that were already set, usually from CLI flags, are kept.
+// Username and port fall back to $USER and 22 when neither sets them
+func ResolveConnection(conn Connection) (Connection, error) {
+	lines, err := loadSSHConfig(conn.SSH_Config)
+	if err != nil {
+		return conn, err
+	}
+	host_config := lookupHost(lines, conn.Target)
+	if conn.Host_Name == "" {
+		conn.Host_Name = host_config.Host_Name
+	}
+	if conn.Host_Name == "" {
+		conn.Host_Name = conn.Target
+	}
+	if conn.Username == "" {
+		conn.Username = host_config.User
+	}
+	if conn.Username == "" {
+		conn.Username = os.Getenv("USER")
+	}
+	if conn.Port == "" {
+		conn.Port = host_config.Port
+	}
+	if conn.Port == "" {
+		conn.Port = "22"
+	}
+	if conn.Proxy_Jump == "" {
+		conn.Proxy_Jump = host_config.Proxy_Jump
+	}
+	if conn.Proxy_Jump == "none" {
+		conn.Proxy_Jump = ""
+	}
+	if conn.Identity_Files == nil {
+		for _, identity_file := range host_config.Identity_Files {
+			conn.Identity_Files = append(conn.Identity_Files, expandConfigPath(identity_file, &conn.Host_Name, &conn.Username))
+		}
+	}
+	return conn, nil
+}
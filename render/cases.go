@@ -0,0 +1,155 @@
+package render
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/mcdonaldseanp/lookout/operation"
+)
+
+const (
+	CASE_PASSED  string = "passed"
+	CASE_FAILED  string = "failed"
+	CASE_SKIPPED string = "skipped"
+)
+
+// A single observation, reaction or action in the results, treated
+// like a test case by the table, junit and tap formats
+type Case struct {
+	// Set when the results came from more than one target
+	Target string
+	// observation, reaction, action or target
+	Kind    string
+	Name    string
+	Status  string
+	Summary string
+	// Output and logs, only shown for cases that didn't pass
+	Details string
+}
+
+// Results from elsewhere, like fleet results from several
+// targets, can list their own cases
+type CaseLister interface {
+	Cases() []Case
+}
+
+func sortedNames[T any](items map[string]T) []string {
+	names := make([]string, 0, len(items))
+	for name := range items {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func details(output string, logs string) string {
+	parts := []string{}
+	if strings.TrimSpace(output) != "" {
+		parts = append(parts, "Output:\n"+strings.TrimSpace(output))
+	}
+	if strings.TrimSpace(logs) != "" {
+		parts = append(parts, "Logs:\n"+strings.TrimSpace(logs))
+	}
+	return strings.Join(parts, "\n")
+}
+
+func observationCases(observations map[string]operation.ObservationResult) []Case {
+	cases := []Case{}
+	for _, obsv_name := range sortedNames(observations) {
+		obsv_result := observations[obsv_name]
+		this := Case{
+			Kind:    "observation",
+			Name:    obsv_name,
+			Status:  CASE_PASSED,
+			Summary: strings.TrimSpace(obsv_result.Result),
+			Details: details(obsv_result.Result, obsv_result.Logs),
+		}
+		if !obsv_result.Succeeded {
+			this.Status = CASE_FAILED
+		} else if !obsv_result.Expected {
+			this.Status = CASE_FAILED
+			this.Summary = fmt.Sprintf("unexpected result '%s'", strings.TrimSpace(obsv_result.Result))
+		}
+		cases = append(cases, this)
+	}
+	return cases
+}
+
+func reactionCases(reactions map[string]operation.ReactionResult) []Case {
+	cases := []Case{}
+	for _, rctn_name := range sortedNames(reactions) {
+		rctn_result := reactions[rctn_name]
+		this := Case{
+			Kind:    "reaction",
+			Name:    rctn_name,
+			Status:  CASE_PASSED,
+			Summary: rctn_result.Message,
+			Details: details(rctn_result.Output, rctn_result.Logs),
+		}
+		if rctn_result.Skipped {
+			this.Status = CASE_SKIPPED
+		} else if !rctn_result.Succeeded {
+			this.Status = CASE_FAILED
+		}
+		cases = append(cases, this)
+	}
+	return cases
+}
+
+func actionCases(actions map[string]operation.ActionResult) []Case {
+	cases := []Case{}
+	for _, actn_name := range sortedNames(actions) {
+		actn_result := actions[actn_name]
+		this := Case{
+			Kind:    "action",
+			Name:    actn_name,
+			Status:  CASE_PASSED,
+			Summary: strings.TrimSpace(actn_result.Output),
+			Details: details(actn_result.Output, actn_result.Logs),
+		}
+		if !actn_result.Succeeded {
+			this.Status = CASE_FAILED
+			this.Summary = "action failed"
+		}
+		cases = append(cases, this)
+	}
+	return cases
+}
+
+// Cases lists the observations, reactions and actions in results
+func Cases(results interface{}) ([]Case, error) {
+	switch typed := results.(type) {
+	case operation.ObservationResults:
+		return observationCases(typed.Observations), nil
+	case *operation.ObservationResults:
+		return observationCases(typed.Observations), nil
+	case operation.ReactionResults:
+		return append(observationCases(typed.Observations), reactionCases(typed.Reactions)...), nil
+	case *operation.ReactionResults:
+		return append(observationCases(typed.Observations), reactionCases(typed.Reactions)...), nil
+	case operation.ActionResults:
+		return actionCases(typed.Actions), nil
+	case *operation.ActionResults:
+		return actionCases(typed.Actions), nil
+	case CaseLister:
+		return typed.Cases(), nil
+	}
+	return nil, fmt.Errorf("results of type %T can only be rendered as json or yaml", results)
+}
+
+// Counts the cases with each status
+func countCases(cases []Case) (int, int, int) {
+	passed, failed, skipped := 0, 0, 0
+	for _, this := range cases {
+		switch this.Status {
+		case CASE_PASSED:
+			passed++
+		case CASE_FAILED:
+			failed++
+		case CASE_SKIPPED:
+			skipped++
+		}
+	}
+	return passed, failed, skipped
+}
@@ -0,0 +1,74 @@
+package render
+
+import (
+	"encoding/xml"
+	"fmt"
+)
+
+type junitMessage struct {
+	Message string `xml:"message,attr,omitempty"`
+	Body    string `xml:",chardata"`
+}
+
+type junitTestCase struct {
+	Class_Name string        `xml:"classname,attr"`
+	Name       string        `xml:"name,attr"`
+	Failure    *junitMessage `xml:"failure,omitempty"`
+	Skipped    *junitMessage `xml:"skipped,omitempty"`
+}
+
+type junitTestSuite struct {
+	Name       string          `xml:"name,attr"`
+	Tests      int             `xml:"tests,attr"`
+	Failures   int             `xml:"failures,attr"`
+	Skipped    int             `xml:"skipped,attr"`
+	Test_Cases []junitTestCase `xml:"testcase"`
+}
+
+type junitTestSuites struct {
+	XMLName     xml.Name         `xml:"testsuites"`
+	Name        string           `xml:"name,attr"`
+	Tests       int              `xml:"tests,attr"`
+	Failures    int              `xml:"failures,attr"`
+	Skipped     int              `xml:"skipped,attr"`
+	Test_Suites []junitTestSuite `xml:"testsuite"`
+}
+
+// junit renders JUnit XML for CI systems. Every kind of case gets
+// its own test suite, per target when there's more than one
+func junit(cases []Case) (string, error) {
+	suites := junitTestSuites{Name: "lookout"}
+	suite_index := make(map[string]int)
+	for _, this := range cases {
+		suite_name := this.Kind + "s"
+		if this.Target != "" {
+			suite_name = this.Target + "." + suite_name
+		}
+		index, found := suite_index[suite_name]
+		if !found {
+			index = len(suites.Test_Suites)
+			suite_index[suite_name] = index
+			suites.Test_Suites = append(suites.Test_Suites, junitTestSuite{Name: suite_name})
+		}
+		suite := &suites.Test_Suites[index]
+		test_case := junitTestCase{Class_Name: suite_name, Name: this.Name}
+		switch this.Status {
+		case CASE_FAILED:
+			test_case.Failure = &junitMessage{Message: this.Summary, Body: this.Details}
+			suite.Failures++
+			suites.Failures++
+		case CASE_SKIPPED:
+			test_case.Skipped = &junitMessage{Message: this.Summary}
+			suite.Skipped++
+			suites.Skipped++
+		}
+		suite.Tests++
+		suites.Tests++
+		suite.Test_Cases = append(suite.Test_Cases, test_case)
+	}
+	xml_output, err := xml.MarshalIndent(suites, "", "  ")
+	if err != nil {
+		return "", fmt.Errorf("could not render result as JUnit XML: %s", err)
+	}
+	return xml.Header + string(xml_output) + "\n", nil
+}
@@ -0,0 +1,95 @@
+package render
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/mcdonaldseanp/clibuild/errtype"
+	"gopkg.in/yaml.v2"
+)
+
+// Output formats for --output
+const (
+	OUTPUT_JSON        string = "json"
+	OUTPUT_JSON_PRETTY string = "json-pretty"
+	OUTPUT_YAML        string = "yaml"
+	OUTPUT_TABLE       string = "table"
+	OUTPUT_JUNIT       string = "junit"
+	OUTPUT_TAP         string = "tap"
+)
+
+var OUTPUTS = []string{OUTPUT_JSON, OUTPUT_JSON_PRETTY, OUTPUT_YAML, OUTPUT_TABLE, OUTPUT_JUNIT, OUTPUT_TAP}
+
+func ValidateFormat(format string) error {
+	for _, known := range OUTPUTS {
+		if format == known {
+			return nil
+		}
+	}
+	return &errtype.InvalidInput{
+		Message: fmt.Sprintf("--output must be one of %s, given '%s'", strings.Join(OUTPUTS, ", "), format),
+		Origin:  nil,
+	}
+}
+
+// Render turns results into text in the given format. json and
+// json-pretty render anything, the other formats need results that
+// can be listed as test cases, see Cases
+func Render(results interface{}, format string, color bool) (string, error) {
+	switch format {
+	case OUTPUT_JSON, "":
+		json_output, err := json.Marshal(results)
+		if err != nil {
+			return "", fmt.Errorf("could not render result as JSON: %s", err)
+		}
+		return string(json_output), nil
+	case OUTPUT_JSON_PRETTY:
+		json_output, err := json.MarshalIndent(results, "", "  ")
+		if err != nil {
+			return "", fmt.Errorf("could not render result as JSON: %s", err)
+		}
+		return string(json_output) + "\n", nil
+	case OUTPUT_YAML:
+		yaml_output, err := yaml.Marshal(results)
+		if err != nil {
+			return "", fmt.Errorf("could not render result as YAML: %s", err)
+		}
+		return string(yaml_output), nil
+	}
+	cases, err := Cases(results)
+	if err != nil {
+		return "", err
+	}
+	switch format {
+	case OUTPUT_TABLE:
+		return table(cases, color), nil
+	case OUTPUT_JUNIT:
+		return junit(cases)
+	case OUTPUT_TAP:
+		return tap(cases), nil
+	}
+	return "", ValidateFormat(format)
+}
+
+// isTerminal reports whether a file is an interactive terminal
+// rather than a pipe or a regular file
+func isTerminal(file *os.File) bool {
+	info, err := file.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice != 0
+}
+
+// Print renders results to stdout. Tables are only coloured
+// when stdout is a terminal
+func Print(results interface{}, format string) error {
+	output, err := Render(results, format, isTerminal(os.Stdout))
+	if err != nil {
+		return err
+	}
+	fmt.Print(output)
+	return nil
+}
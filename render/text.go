@@ -0,0 +1,133 @@
+package render
+
+import (
+	"fmt"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	color_reset  string = "\033[0m"
+	color_red    string = "\033[31m"
+	color_green  string = "\033[32m"
+	color_yellow string = "\033[33m"
+)
+
+var table_status = map[string]string{
+	CASE_PASSED:  "PASS",
+	CASE_FAILED:  "FAIL",
+	CASE_SKIPPED: "SKIP",
+}
+
+var table_color = map[string]string{
+	CASE_PASSED:  color_green,
+	CASE_FAILED:  color_red,
+	CASE_SKIPPED: color_yellow,
+}
+
+// oneLine squashes text onto a single line that fits in a table
+func oneLine(text string, max_length int) string {
+	line := strings.Join(strings.Fields(text), " ")
+	if len(line) > max_length {
+		line = line[:max_length-3] + "..."
+	}
+	return line
+}
+
+func hasTargets(cases []Case) bool {
+	for _, this := range cases {
+		if this.Target != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// table renders a summary for people to read, with one row per case
+// and the totals at the end
+func table(cases []Case, color bool) string {
+	rows := [][]string{{"STATUS", "KIND", "NAME", "SUMMARY"}}
+	with_targets := hasTargets(cases)
+	if with_targets {
+		rows[0] = append([]string{"TARGET"}, rows[0]...)
+	}
+	for _, this := range cases {
+		row := []string{table_status[this.Status], this.Kind, this.Name, oneLine(this.Summary, 60)}
+		if with_targets {
+			row = append([]string{this.Target}, row...)
+		}
+		rows = append(rows, row)
+	}
+	widths := make([]int, len(rows[0]))
+	for _, row := range rows {
+		for column, cell := range row {
+			if len(cell) > widths[column] {
+				widths[column] = len(cell)
+			}
+		}
+	}
+	status_column := 0
+	if with_targets {
+		status_column = 1
+	}
+	var builder strings.Builder
+	for index, row := range rows {
+		cells := make([]string, len(row))
+		for column, cell := range row {
+			// The last column isn't padded so lines don't end in spaces
+			if column < len(row)-1 {
+				cell = fmt.Sprintf("%-*s", widths[column], cell)
+			}
+			// Pad before colouring so the escape codes don't
+			// count towards the width
+			if color && index > 0 && column == status_column {
+				cell = table_color[cases[index-1].Status] + cell + color_reset
+			}
+			cells[column] = cell
+		}
+		builder.WriteString(strings.TrimRight(strings.Join(cells, "  "), " ") + "\n")
+	}
+	passed, failed, skipped := countCases(cases)
+	builder.WriteString(fmt.Sprintf("\n%d passed, %d failed, %d skipped\n", passed, failed, skipped))
+	return builder.String()
+}
+
+func caseTitle(this Case) string {
+	title := this.Kind + " " + this.Name
+	if this.Target != "" {
+		title = this.Target + " " + title
+	}
+	return title
+}
+
+// tap renders the Test Anything Protocol, version 13 so that
+// failures can carry a yaml block with the details
+func tap(cases []Case) string {
+	var builder strings.Builder
+	builder.WriteString("TAP version 13\n")
+	builder.WriteString(fmt.Sprintf("1..%d\n", len(cases)))
+	for index, this := range cases {
+		switch this.Status {
+		case CASE_PASSED:
+			builder.WriteString(fmt.Sprintf("ok %d - %s\n", index+1, caseTitle(this)))
+		case CASE_SKIPPED:
+			builder.WriteString(fmt.Sprintf("ok %d - %s # SKIP %s\n", index+1, caseTitle(this), oneLine(this.Summary, 200)))
+		default:
+			builder.WriteString(fmt.Sprintf("not ok %d - %s\n", index+1, caseTitle(this)))
+			diagnostic, err := yaml.Marshal(map[string]string{
+				"message": this.Summary,
+				"details": this.Details,
+			})
+			if err != nil {
+				continue
+			}
+			builder.WriteString("  ---\n")
+			for _, line := range strings.Split(strings.TrimRight(string(diagnostic), "\n"), "\n") {
+				builder.WriteString("  " + line + "\n")
+			}
+			builder.WriteString("  ...\n")
+		}
+	}
+	return builder.String()
+}